@@ -1,13 +1,75 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"io"
 	"log"
 	"net"
+	"os"
+	"protohackers/2_means/store"
+	"time"
 )
 
 func main() {
+	dataDir := flag.String("data", "means_data", "directory to persist the shared store in")
+	export := flag.Bool("export", false, "dump the shared store as csv to stdout, then exit. per connection sessions are never kept, so they can't be exported")
+	symbol := flag.String("symbol", "", "only export this symbol")
+	syncEvery := flag.Duration("sync", 100*time.Millisecond, "how often inserts get fsynced. a crash loses at most this much. 0 fsyncs every insert before it's acknowledged")
+	flag.Parse()
+
+	// reject duplicates so one producer can't silently skew another's prices.
+	policy := store.Reject
+
+	if *export {
+		s, err := store.OpenReadOnly(*dataDir, policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer s.Close()
+
+		symbols := make([]string, 0)
+		if *symbol != "" {
+			symbols = append(symbols, *symbol)
+		}
+		err = s.Export(os.Stdout, symbols...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// shared between every connection.
+	shared, err := store.Open(*dataDir, policy)
+	if err != nil {
+		panic(err)
+	}
+	defer shared.Close()
+
+	if *syncEvery == 0 {
+		shared.SyncEveryInsert()
+	} else {
+		go func() {
+			for range time.Tick(*syncEvery) {
+				err := shared.Sync()
+				if err != nil {
+					log.Println("sync failed:", err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			err := shared.Compact()
+			if err != nil {
+				log.Println("compaction failed:", err)
+			}
+		}
+	}()
+
 	addr := ":8000"
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -23,27 +85,34 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		go means(c)
+		go means(c, shared)
 	}
 }
 
+// Symbol is only filled for the shared ('i' and 'q') messages.
 type Insert struct {
+	Symbol    string
 	Timestamp int
 	Price     int
+	Shared    bool
 }
 
 type Query struct {
+	Symbol  string
 	Mintime int
 	Maxtime int
+	Shared  bool
 }
 
-func means(c net.Conn) {
+func means(c net.Conn, shared *store.Store) {
 	defer c.Close()
 
-	sess := make([]*Insert, 0)
+	// the original per connection session.
+	// keeps duplicates around and inserts are just an append, like it always was.
+	sess := store.NewStore(store.KeepBoth)
+	r := bufio.NewReader(c)
 	for {
-		b := make([]byte, 9)
-		_, err := io.ReadFull(c, b)
+		b, err := readPacket(r)
 		if err != nil {
 			log.Println(err)
 			break
@@ -56,27 +125,29 @@ func means(c net.Conn) {
 		}
 
 		if i != nil {
-			sess = append(sess, i)
-			log.Println("insert", i)
+			s := sess
+			if i.Shared {
+				s = shared
+			}
+			err := s.Insert(i.Symbol, i.Timestamp, i.Price)
+			if err != nil {
+				log.Println("insert", i, "failed:", err)
+			} else {
+				log.Println("insert", i)
+			}
 		}
 
 		if q != nil {
-			tally := 0
-			count := 0
-			for _, s := range sess {
-				inside := (q.Mintime <= s.Timestamp) && (s.Timestamp <= q.Maxtime)
-				if !inside {
-					continue
-				}
-
-				tally += s.Price
-				count += 1
+			s := sess
+			if q.Shared {
+				s = shared
 			}
-
-			var result uint32
-			if count != 0 {
-				result = uint32(tally / count)
+			mean, err := s.Query(q.Symbol, q.Mintime, q.Maxtime)
+			if err != nil {
+				log.Println("query", q, "failed:", err)
 			}
+			result := uint32(mean)
+
 			resp := make([]byte, 4)
 			binary.BigEndian.PutUint32(resp, result)
 			c.Write(resp)
@@ -85,26 +156,78 @@ func means(c net.Conn) {
 	}
 }
 
+// reads a whole packet, type byte included.
+//
+// 'I' and 'Q' are the usual 9 byte packets.
+// 'i' and 'q' carry an asset symbol and go to the shared store.
+// the symbol is length prefixed with a single byte and sits right after the type:
+//
+//	type (1) | symbol length (1) | symbol | int32 | int32
+func readPacket(r *bufio.Reader) ([]byte, error) {
+	t, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	size := 9
+	if t[0] == 'i' || t[0] == 'q' {
+		head, err := r.Peek(2)
+		if err != nil {
+			return nil, err
+		}
+		size = 2 + int(head[1]) + 8
+	}
+
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, io.EOF
+	}
+	return b, err
+}
+
 func parsePacket(b []byte) (*Insert, *Query) {
+	if len(b) == 0 {
+		return nil, nil
+	}
 	t := b[0]
+	b = b[1:]
+
+	var symbol string
+	shared := t == 'i' || t == 'q'
+	if shared {
+		if len(b) == 0 || len(b) < 1+int(b[0]) {
+			return nil, nil
+		}
+		symbol = string(b[1 : 1+b[0]])
+		b = b[1+b[0]:]
+	}
+
+	if len(b) != 8 {
+		return nil, nil
+	}
 
 	// uint32 -> int32 -> int
 	// casting directly to int will break negative numbers on 64 bit systems
-	firstint := b[1:5]
+	firstint := b[0:4]
 	firstnum := int(int32(binary.BigEndian.Uint32(firstint)))
 
-	secint := b[5:9]
+	secint := b[4:8]
 	secnum := int(int32(binary.BigEndian.Uint32(secint)))
 
-	if t == 'Q' {
+	if t == 'Q' || t == 'q' {
 		return nil, &Query{
+			Symbol:  symbol,
 			Mintime: firstnum,
 			Maxtime: secnum,
+			Shared:  shared,
 		}
-	} else if t == 'I' {
+	} else if t == 'I' || t == 'i' {
 		return &Insert{
+			Symbol:    symbol,
 			Timestamp: firstnum,
 			Price:     secnum,
+			Shared:    shared,
 		}, nil
 	}
 	return nil, nil
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"io"
 	"testing"
 )
 
@@ -37,3 +40,56 @@ func TestParseQuery(t *testing.T) {
 		t.Fatalf("wrong maxtime. got %v expected %v", query.Maxtime, exp_maxtime)
 	}
 }
+
+func TestParseSharedQuery(t *testing.T) {
+	in := []byte{0x71, 0x03, 'B', 'T', 'C', 0x00, 0x00, 0x30, 0x39, 0xFF, 0xFF, 0xFF, 0xFF}
+	exp_symbol := "BTC"
+	exp_mintime := 12345
+	exp_maxtime := -1
+
+	_, query := parsePacket(in)
+	if query == nil {
+		t.Fatalf("Failed to parse packet")
+	}
+	if !query.Shared {
+		t.Fatalf("expected query to go to the shared store")
+	}
+	if query.Symbol != exp_symbol {
+		t.Fatalf("wrong symbol. got %v expected %v", query.Symbol, exp_symbol)
+	}
+	if query.Mintime != exp_mintime {
+		t.Fatalf("wrong mintime. got %v expected %v", query.Mintime, exp_mintime)
+	}
+	if query.Maxtime != exp_maxtime {
+		t.Fatalf("wrong maxtime. got %v expected %v", query.Maxtime, exp_maxtime)
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	in := []byte{
+		0x49, 0x00, 0x00, 0x30, 0x39, 0x00, 0x00, 0x00, 0x65,
+		0x69, 0x03, 'B', 'T', 'C', 0x00, 0x00, 0x30, 0x39, 0x00, 0x00, 0x00, 0x65,
+	}
+	r := bufio.NewReader(bytes.NewReader(in))
+
+	first, err := readPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, in[:9]) {
+		t.Fatalf("wrong first packet. got %v expected %v", first, in[:9])
+	}
+
+	second, err := readPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(second, in[9:]) {
+		t.Fatalf("wrong second packet. got %v expected %v", second, in[9:])
+	}
+
+	_, err = readPacket(r)
+	if err != io.EOF {
+		t.Fatalf("expected EOF. got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"slices"
+)
+
+// Prices that aren't in a segment yet, in the order they came in.
+//
+// Inserts are an append no matter how out of order the timestamps are, like the original session was.
+// Queries scan, and the prices only get sorted once they're flushed into a segment.
+// Duplicates are found through an index of timestamps, which KeepBoth doesn't need.
+type memtable struct {
+	assets map[string][]Price
+	index  map[string]map[int]int // by symbol, then timestamp, to the position in assets. nil for KeepBoth.
+	policy DuplicatePolicy
+}
+
+func makeMemtable(policy DuplicatePolicy) *memtable {
+	m := &memtable{
+		assets: make(map[string][]Price),
+		policy: policy,
+	}
+	if policy != KeepBoth {
+		m.index = make(map[string]map[int]int)
+	}
+	return m
+}
+
+func (m *memtable) insert(symbol string, p Price) {
+	if m.index == nil {
+		m.assets[symbol] = append(m.assets[symbol], p)
+		return
+	}
+
+	idx := m.index[symbol]
+	if idx == nil {
+		idx = make(map[int]int)
+		m.index[symbol] = idx
+	}
+	if i, ok := idx[p.Timestamp]; ok {
+		if m.policy == Overwrite {
+			m.assets[symbol][i].Price = p.Price
+		}
+		return
+	}
+	idx[p.Timestamp] = len(m.assets[symbol])
+	m.assets[symbol] = append(m.assets[symbol], p)
+}
+
+func (m *memtable) has(symbol string, timestamp int) bool {
+	if m.index != nil {
+		_, ok := m.index[symbol][timestamp]
+		return ok
+	}
+	return slices.ContainsFunc(m.assets[symbol], func(p Price) bool {
+		return p.Timestamp == timestamp
+	})
+}
+
+// prices of the symbol between mintime and maxtime, inclusive. not sorted.
+func (m *memtable) prices(symbol string, mintime int, maxtime int) []Price {
+	ret := make([]Price, 0)
+	for _, p := range m.assets[symbol] {
+		if mintime <= p.Timestamp && p.Timestamp <= maxtime {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// everything sorted by timestamp, ready for a segment.
+// stable, so KeepBoth duplicates stay in the order they came in.
+func (m *memtable) sorted() map[string][]Price {
+	ret := make(map[string][]Price, len(m.assets))
+	for symbol, prices := range m.assets {
+		sorted := slices.Clone(prices)
+		slices.SortStableFunc(sorted, func(a, b Price) int {
+			return a.Timestamp - b.Timestamp
+		})
+		ret[symbol] = sorted
+	}
+	return ret
+}
+
+func (m *memtable) len() int {
+	return len(m.assets)
+}
@@ -0,0 +1,306 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
+
+var (
+	errInvalidSegment = fmt.Errorf("invalid segment file")
+)
+
+const segmentMagic = "MSEG"
+
+// Immutable file of prices sorted by symbol, then by timestamp.
+//
+// Layout:
+//
+//	"MSEG" | lo uint32 | hi uint32 | block...
+//
+// where each block is
+//
+//	symbol length (1) | symbol | count uint32 | (timestamp int32 | price int32) * count
+//
+// lo and hi are the generations this segment covers.
+// a freshly flushed memtable covers just itself, merged segments cover everything they replaced.
+type segment struct {
+	lo     int
+	hi     int
+	f      *os.File
+	blocks map[string]block
+}
+
+type block struct {
+	offset int64 // offset of the first price
+	count  int
+	// first and last timestamp. lookups outside of them don't need to touch the file.
+	min int
+	max int
+}
+
+func segmentName(id int) string {
+	return fmt.Sprintf("segment-%06d.seg", id)
+}
+
+// opens every segment in the directory, oldest first.
+// segments that got swallowed by a merge but weren't deleted yet are skipped,
+// and cleaned up too unless readonly. a store that's open elsewhere might still be reading them.
+func openSegments(dir string, readonly bool) ([]*segment, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "segment-*.seg"))
+	if err != nil {
+		return nil, err
+	}
+
+	segs := make([]*segment, 0)
+	for _, p := range paths {
+		sg, err := openSegment(p)
+		if err != nil {
+			for _, s := range segs {
+				s.close()
+			}
+			return nil, fmt.Errorf("%v: %w", p, err)
+		}
+		segs = append(segs, sg)
+	}
+
+	// widest range first, so it gets to swallow the smaller ones
+	slices.SortFunc(segs, func(a, b *segment) int {
+		return (b.hi - b.lo) - (a.hi - a.lo)
+	})
+	kept := make([]*segment, 0)
+	for _, sg := range segs {
+		covered := slices.ContainsFunc(kept, func(k *segment) bool {
+			return k.lo <= sg.lo && sg.hi <= k.hi
+		})
+		if covered {
+			if readonly {
+				sg.close()
+			} else {
+				sg.remove()
+			}
+			continue
+		}
+		kept = append(kept, sg)
+	}
+
+	slices.SortFunc(kept, func(a, b *segment) int {
+		return a.hi - b.hi
+	})
+	return kept, nil
+}
+
+func openSegment(path string) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sg := &segment{
+		f:      f,
+		blocks: make(map[string]block),
+	}
+	err = sg.readIndex()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sg, nil
+}
+
+// walks the block headers so we know where each symbol lives.
+// the prices themselves are only read when queried.
+func (sg *segment) readIndex() error {
+	r := bufio.NewReader(sg.f)
+
+	header := make([]byte, len(segmentMagic)+8)
+	_, err := io.ReadFull(r, header)
+	if err != nil || string(header[:len(segmentMagic)]) != segmentMagic {
+		return errInvalidSegment
+	}
+	sg.lo = int(binary.BigEndian.Uint32(header[4:8]))
+	sg.hi = int(binary.BigEndian.Uint32(header[8:12]))
+	offset := int64(len(header))
+
+	for {
+		l, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		b := make([]byte, int(l)+4)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return errInvalidSegment
+		}
+		symbol := string(b[:l])
+		count := int(binary.BigEndian.Uint32(b[l:]))
+		offset += 1 + int64(len(b))
+
+		bl := block{
+			offset: offset,
+			count:  count,
+		}
+		if count > 0 {
+			bl.min, err = sg.timestampAt(offset)
+			if err == nil {
+				bl.max, err = sg.timestampAt(offset + int64(count-1)*8)
+			}
+			if err != nil {
+				return errInvalidSegment
+			}
+		}
+		sg.blocks[symbol] = bl
+
+		skip := int64(count) * 8
+		_, err = r.Discard(int(skip))
+		if err != nil {
+			return errInvalidSegment
+		}
+		offset += skip
+	}
+}
+
+func (sg *segment) timestampAt(offset int64) (int, error) {
+	b := make([]byte, 4)
+	_, err := sg.f.ReadAt(b, offset)
+	return int(int32(binary.BigEndian.Uint32(b))), err
+}
+
+// prices of the symbol between mintime and maxtime, inclusive.
+func (sg *segment) prices(symbol string, mintime int, maxtime int) ([]Price, error) {
+	bl, ok := sg.blocks[symbol]
+	if !ok || mintime > maxtime || bl.count == 0 || maxtime < bl.min || mintime > bl.max {
+		return nil, nil
+	}
+
+	// binary search straight on the file.
+	// sort.Search can't bail out so we hold on to the first error.
+	var searchErr error
+	timestampAt := func(i int) int {
+		ts, err := sg.timestampAt(bl.offset + int64(i)*8)
+		if err != nil && searchErr == nil {
+			searchErr = err
+		}
+		return ts
+	}
+
+	start := sort.Search(bl.count, func(i int) bool {
+		return timestampAt(i) >= mintime
+	})
+	end := sort.Search(bl.count, func(i int) bool {
+		return timestampAt(i) > maxtime
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	if start >= end {
+		return nil, nil
+	}
+
+	b := make([]byte, (end-start)*8)
+	_, err := sg.f.ReadAt(b, bl.offset+int64(start)*8)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Price, end-start)
+	for i := range ret {
+		ret[i] = decodePrice(b[i*8:])
+	}
+	return ret, nil
+}
+
+func (sg *segment) symbols() []string {
+	ret := make([]string, 0, len(sg.blocks))
+	for symbol := range sg.blocks {
+		ret = append(ret, symbol)
+	}
+	return ret
+}
+
+func (sg *segment) close() error {
+	return sg.f.Close()
+}
+
+// close and delete the segment
+func (sg *segment) remove() error {
+	sg.f.Close()
+	return os.Remove(sg.f.Name())
+}
+
+// writes the prices as a segment covering generations lo to hi.
+// prices of each symbol needs to be sorted already.
+//
+// the file only shows up under its real name after it is fully synced,
+// so a crash never leaves a half written segment behind.
+func writeSegment(dir string, lo int, hi int, assets map[string][]Price) (*segment, error) {
+	path := filepath.Join(dir, segmentName(hi))
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	w.WriteString(segmentMagic)
+	binary.Write(w, binary.BigEndian, uint32(lo))
+	binary.Write(w, binary.BigEndian, uint32(hi))
+
+	symbols := make([]string, 0, len(assets))
+	for symbol := range assets {
+		symbols = append(symbols, symbol)
+	}
+	slices.Sort(symbols)
+
+	for _, symbol := range symbols {
+		prices := assets[symbol]
+		w.WriteByte(byte(len(symbol)))
+		w.WriteString(symbol)
+		binary.Write(w, binary.BigEndian, uint32(len(prices)))
+		for _, p := range prices {
+			binary.Write(w, binary.BigEndian, int32(p.Timestamp))
+			binary.Write(w, binary.BigEndian, int32(p.Price))
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	err = syncDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return openSegment(path)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
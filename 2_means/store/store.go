@@ -0,0 +1,476 @@
+package store
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+var (
+	ErrDuplicate = fmt.Errorf("duplicate timestamp")
+	ErrReadOnly  = fmt.Errorf("store is read only")
+)
+
+// merge everything into one segment once we have more than this
+const maxSegments = 4
+
+// What to do when an insert hits a timestamp that already exists for the asset.
+type DuplicatePolicy int
+
+const (
+	// keep both prices. both of them count towards the mean.
+	// this is what the original per-connection session does.
+	KeepBoth DuplicatePolicy = iota
+	// drop the new price and return ErrDuplicate.
+	Reject
+	// replace the old price with the new one.
+	Overwrite
+)
+
+type Price struct {
+	Timestamp int
+	Price     int
+}
+
+// Price store shared between connections.
+// Prices are grouped by asset symbol. Segments keep them sorted by timestamp, the memtable in the order they came in.
+//
+// Stores made with Open are also backed by a directory.
+// Inserts go to the write ahead log first, then to the memtable.
+// The log is only fsynced on Sync, or on every insert with SyncEveryInsert.
+// Compact flushes the memtable into a sorted segment file.
+// Queries read the memtable and the segments together.
+//
+// Compaction only holds the lock to swap things in and out, inserts and queries go on while it writes.
+type Store struct {
+	memtable *memtable
+	policy   DuplicatePolicy
+	mu       sync.RWMutex
+
+	// only used by stores backed by a directory
+	dir       string
+	wal       *wal
+	flushing  *flush     // on its way into a segment, still read until it's there
+	segments  []*segment // oldest first
+	gen       int        // generation of the memtable. it becomes segment gen once compacted.
+	readonly  bool
+	syncWal   bool       // fsync the log on every insert
+	compactMu sync.Mutex // one compaction at a time. only compaction changes the segments.
+}
+
+// a memtable being written into a segment, and the write ahead log that covers it
+type flush struct {
+	mem *memtable
+	wal *wal
+	gen int
+}
+
+// in memory only store
+func NewStore(policy DuplicatePolicy) *Store {
+	return &Store{
+		memtable: makeMemtable(policy),
+		policy:   policy,
+	}
+}
+
+// opens the store persisted in dir, creating it if needed.
+// anything in the write ahead log gets replayed into memory.
+func Open(dir string, policy DuplicatePolicy) (*Store, error) {
+	return open(dir, policy, false)
+}
+
+// same as Open but never writes to the directory.
+// safe to use while another process has the store open.
+func OpenReadOnly(dir string, policy DuplicatePolicy) (*Store, error) {
+	return open(dir, policy, true)
+}
+
+func open(dir string, policy DuplicatePolicy, readonly bool) (*Store, error) {
+	if !readonly {
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := NewStore(policy)
+	s.dir = dir
+	s.readonly = readonly
+	s.gen = 1
+
+	segs, err := openSegments(dir, readonly)
+	if err != nil {
+		return nil, err
+	}
+	s.segments = segs
+	if len(segs) > 0 {
+		s.gen = segs[len(segs)-1].hi + 1
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	slices.Sort(paths)
+
+	var size int64
+	for _, p := range paths {
+		var id int
+		_, err := fmt.Sscanf(filepath.Base(p), "wal-%06d.log", &id)
+		if err != nil {
+			continue
+		}
+
+		// already made it into a segment
+		if id < s.gen {
+			if !readonly {
+				os.Remove(p)
+			}
+			continue
+		}
+
+		size, err = replayWal(p, func(symbol string, p Price) {
+			s.memtable.insert(symbol, p)
+		})
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.gen = id
+	}
+
+	if !readonly {
+		s.wal, err = openWal(dir, s.gen, size)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) Insert(symbol string, timestamp int, price int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readonly {
+		return ErrReadOnly
+	}
+
+	p := Price{
+		Timestamp: timestamp,
+		Price:     price,
+	}
+
+	if s.policy == Reject {
+		exists, err := s.exists(symbol, timestamp)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrDuplicate
+		}
+	}
+
+	if s.wal != nil {
+		err := s.wal.append(symbol, p)
+		if err == nil && s.syncWal {
+			err = s.wal.sync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.memtable.insert(symbol, p)
+	return nil
+}
+
+// gets the write ahead log onto the disk
+// inserts can go on meanwhile, only compaction swaps the log out.
+func (s *Store) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.sync()
+}
+
+// makes every insert wait for the write ahead log to hit the disk.
+// nothing acknowledged gets lost, but inserts get as slow as the disk.
+func (s *Store) SyncEveryInsert() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncWal = true
+}
+
+// segments only get read for timestamps inside the range they have for the symbol
+func (s *Store) exists(symbol string, timestamp int) (bool, error) {
+	if s.memtable.has(symbol, timestamp) {
+		return true, nil
+	}
+	if s.flushing != nil && s.flushing.mem.has(symbol, timestamp) {
+		return true, nil
+	}
+	for _, sg := range s.segments {
+		prices, err := sg.prices(symbol, timestamp, timestamp)
+		if err != nil {
+			return false, err
+		}
+		if len(prices) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mean price of the asset between mintime and maxtime, inclusive.
+// returns 0 if there are no prices in that range.
+func (s *Store) Query(symbol string, mintime int, maxtime int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prices, err := s.collect(symbol, mintime, maxtime)
+	if err != nil {
+		return 0, err
+	}
+	return mean(prices), nil
+}
+
+// dumps every price of the symbols as csv, by symbol then timestamp.
+// everything in the store if no symbols are given.
+func (s *Store) Export(w io.Writer, symbols ...string) error {
+	s.mu.RLock()
+	if len(symbols) == 0 {
+		symbols = s.symbols()
+	}
+	assets := make(map[string][]Price, len(symbols))
+	for _, symbol := range symbols {
+		prices, err := s.collect(symbol, math.MinInt32, math.MaxInt32)
+		if err != nil {
+			s.mu.RUnlock()
+			return err
+		}
+		assets[symbol] = prices
+	}
+	s.mu.RUnlock()
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"symbol", "timestamp", "price"})
+	for _, symbol := range symbols {
+		for _, p := range assets[symbol] {
+			cw.Write([]string{
+				symbol,
+				strconv.Itoa(p.Timestamp),
+				strconv.Itoa(p.Price),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// every symbol with a price anywhere, sorted
+func (s *Store) symbols() []string {
+	seen := make(map[string]bool)
+	for symbol := range s.memtable.assets {
+		seen[symbol] = true
+	}
+	if s.flushing != nil {
+		for symbol := range s.flushing.mem.assets {
+			seen[symbol] = true
+		}
+	}
+	for _, sg := range s.segments {
+		for _, symbol := range sg.symbols() {
+			seen[symbol] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// prices of the symbol from the memtable and every segment, sorted by timestamp.
+func (s *Store) collect(symbol string, mintime int, maxtime int) ([]Price, error) {
+	if mintime > maxtime {
+		return nil, nil
+	}
+
+	// newest first
+	layers := make([][]Price, 0, len(s.segments)+2)
+	layers = append(layers, s.memtable.prices(symbol, mintime, maxtime))
+	if s.flushing != nil {
+		layers = append(layers, s.flushing.mem.prices(symbol, mintime, maxtime))
+	}
+
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		prices, err := s.segments[i].prices(symbol, mintime, maxtime)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, prices)
+	}
+
+	return mergeLayers(layers, s.policy), nil
+}
+
+// layers needs to be ordered newest first.
+// with Overwrite, newer layers shadow the same timestamp in older ones.
+func mergeLayers(layers [][]Price, policy DuplicatePolicy) []Price {
+	ret := make([]Price, 0)
+	seen := make(map[int]bool)
+	for _, layer := range layers {
+		for _, p := range layer {
+			if policy == Overwrite {
+				if seen[p.Timestamp] {
+					continue
+				}
+				seen[p.Timestamp] = true
+			}
+			ret = append(ret, p)
+		}
+	}
+
+	slices.SortStableFunc(ret, func(a, b Price) int {
+		return a.Timestamp - b.Timestamp
+	})
+	return ret
+}
+
+// flushes the memtable into a new segment and starts a fresh write ahead log.
+// merges all segments into one if there are too many of them.
+// does nothing for in memory stores.
+//
+// the memtable gets swapped for an empty one under the lock, the segment is written without it.
+// if writing fails, the next compaction tries the same memtable again.
+func (s *Store) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	if s.flushing == nil {
+		if s.wal == nil || s.memtable.len() == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		next, err := openWal(s.dir, s.gen+1, 0)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.flushing = &flush{
+			mem: s.memtable,
+			wal: s.wal,
+			gen: s.gen,
+		}
+		s.memtable = makeMemtable(s.policy)
+		s.wal = next
+		s.gen++
+	}
+	fl := s.flushing
+	s.mu.Unlock()
+
+	seg, err := writeSegment(s.dir, fl.gen, fl.gen, fl.mem.sorted())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.segments = append(s.segments, seg)
+	s.flushing = nil
+	s.mu.Unlock()
+	fl.wal.remove()
+
+	if len(s.segments) > maxSegments {
+		return s.mergeSegments()
+	}
+	return nil
+}
+
+// needs compactMu. reads the segments without the lock, nothing else changes them and their files never change.
+func (s *Store) mergeSegments() error {
+	segs := s.segments
+
+	symbols := make(map[string]bool)
+	for _, sg := range segs {
+		for _, symbol := range sg.symbols() {
+			symbols[symbol] = true
+		}
+	}
+
+	assets := make(map[string][]Price)
+	for symbol := range symbols {
+		layers := make([][]Price, 0, len(segs))
+		for i := len(segs) - 1; i >= 0; i-- {
+			prices, err := segs[i].prices(symbol, math.MinInt32, math.MaxInt32)
+			if err != nil {
+				return err
+			}
+			layers = append(layers, prices)
+		}
+		assets[symbol] = mergeLayers(layers, s.policy)
+	}
+
+	// takes over the newest one's file name.
+	// queries still reading the old file keep the one they opened.
+	newest := segs[len(segs)-1]
+	merged, err := writeSegment(s.dir, segs[0].lo, newest.hi, assets)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.segments = []*segment{merged}
+	s.mu.Unlock()
+
+	// nobody can get to the old ones any more
+	newest.close()
+	for _, sg := range segs[:len(segs)-1] {
+		sg.remove()
+	}
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.wal != nil {
+		err = s.wal.close()
+		s.wal = nil
+	}
+	// a failed flush. its write ahead log still has everything.
+	if s.flushing != nil {
+		s.flushing.wal.close()
+		s.flushing = nil
+	}
+	for _, sg := range s.segments {
+		sg.close()
+	}
+	s.segments = nil
+	return err
+}
+
+func mean(prices []Price) int {
+	if len(prices) == 0 {
+		return 0
+	}
+
+	tally := 0
+	for _, p := range prices {
+		tally += p.Price
+	}
+	return tally / len(prices)
+}
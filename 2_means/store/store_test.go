@@ -0,0 +1,298 @@
+package store_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"protohackers/2_means/store"
+	"strings"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	s := store.NewStore(store.Reject)
+
+	s.Insert("BTC", 12345, 101)
+	s.Insert("BTC", 12346, 102)
+	s.Insert("BTC", 12347, 100)
+	s.Insert("BTC", 40960, 5)
+	s.Insert("ETH", 12345, 1000)
+
+	type queryCases struct {
+		symbol  string
+		mintime int
+		maxtime int
+		exp     int
+	}
+
+	cases := []queryCases{
+		{"BTC", 12288, 16384, 101},
+		{"BTC", 0, 100000, 77},
+		{"BTC", 16384, 12288, 0},
+		{"ETH", 12288, 16384, 1000},
+		{"DOGE", 12288, 16384, 0},
+	}
+
+	for _, c := range cases {
+		out, err := s.Query(c.symbol, c.mintime, c.maxtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != c.exp {
+			t.Fatalf("wrong mean for %v [%v, %v]. expected %v got %v", c.symbol, c.mintime, c.maxtime, c.exp, out)
+		}
+	}
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	type policyCases struct {
+		policy store.DuplicatePolicy
+		err    error
+		exp    int
+	}
+
+	cases := []policyCases{
+		{store.KeepBoth, nil, 150},
+		{store.Reject, store.ErrDuplicate, 100},
+		{store.Overwrite, nil, 200},
+	}
+
+	for _, c := range cases {
+		s := store.NewStore(c.policy)
+		s.Insert("BTC", 10, 100)
+		err := s.Insert("BTC", 10, 200)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("wrong error for policy %v. expected %v got %v", c.policy, c.err, err)
+		}
+
+		out, err := s.Query("BTC", 0, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != c.exp {
+			t.Fatalf("wrong mean for policy %v. expected %v got %v", c.policy, c.exp, out)
+		}
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := store.Open(dir, store.Overwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Insert("BTC", 10, 100)
+	s.Insert("BTC", 20, 200)
+	err = s.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shadows the price in the segment
+	s.Insert("BTC", 20, 400)
+	s.Insert("BTC", 30, 300)
+	s.Close()
+
+	s, err = store.Open(dir, store.Overwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	out, err := s.Query("BTC", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != 266 {
+		t.Fatalf("wrong mean after restart. expected %v got %v", 266, out)
+	}
+
+	// enough to trigger a merge
+	for i := 0; i < 6; i++ {
+		s.Insert("ETH", i, 10)
+		err = s.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err = s.Query("BTC", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != 266 {
+		t.Fatalf("wrong mean after merge. expected %v got %v", 266, out)
+	}
+
+	b := new(bytes.Buffer)
+	err = s.Export(b, "BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "symbol,timestamp,price\nBTC,10,100\nBTC,20,400\nBTC,30,300\n"
+	if b.String() != exp {
+		t.Fatalf("wrong export. expected %q got %q", exp, b.String())
+	}
+
+	b.Reset()
+	err = s.Export(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = "symbol,timestamp,price\nBTC,10,100\nBTC,20,400\nBTC,30,300\nETH,0,10\nETH,1,10\nETH,2,10\nETH,3,10\nETH,4,10\nETH,5,10\n"
+	if b.String() != exp {
+		t.Fatalf("wrong export of everything. expected %q got %q", exp, b.String())
+	}
+}
+
+// duplicates get found in whichever segment has them, and only there
+func TestRejectAcrossSegments(t *testing.T) {
+	s, err := store.Open(t.TempDir(), store.Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SyncEveryInsert()
+
+	for _, ts := range [][]int{{10, 20}, {30, 40}} {
+		for _, timestamp := range ts {
+			err := s.Insert("BTC", timestamp, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := s.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type rejectCases struct {
+		symbol    string
+		timestamp int
+		err       error
+	}
+	cases := []rejectCases{
+		{"BTC", 10, store.ErrDuplicate},
+		{"BTC", 40, store.ErrDuplicate},
+		{"BTC", 15, nil},
+		{"BTC", 25, nil},
+		{"BTC", 50, nil},
+		{"ETH", 10, nil},
+	}
+	for _, c := range cases {
+		err := s.Insert(c.symbol, c.timestamp, 200)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("wrong error for %v at %v. expected %v got %v", c.symbol, c.timestamp, c.err, err)
+		}
+	}
+}
+
+// timestamps can come in any order, inserting shouldn't care
+func BenchmarkInsertOutOfOrder(b *testing.B) {
+	for _, policy := range []store.DuplicatePolicy{store.KeepBoth, store.Reject} {
+		b.Run(fmt.Sprint(policy), func(b *testing.B) {
+			s := store.NewStore(policy)
+			for i := 0; i < b.N; i++ {
+				s.Insert("BTC", rand.IntN(1<<30), i)
+			}
+		})
+	}
+}
+
+// a segment that got merged away but is still on disk, like after a crash mid merge.
+// a read only store can't tell whether someone else is still reading it, so it stays.
+func TestReadOnlyKeepsFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := store.Open(dir, store.Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Insert("BTC", 10, 100)
+	s.Compact()
+	first := filepath.Join(dir, "segment-000001.seg")
+	b, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough to trigger a merge
+	for i := 0; i < 5; i++ {
+		s.Insert("ETH", i, 10)
+		s.Compact()
+	}
+	s.Close()
+	os.WriteFile(first, b, 0o644)
+
+	ro, err := store.OpenReadOnly(dir, store.Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ro.Query("BTC", 0, 100)
+	ro.Close()
+	if out != 100 {
+		t.Fatalf("wrong mean. expected %v got %v", 100, out)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Fatalf("read only store removed a segment: %v", err)
+	}
+
+	s, err = store.Open(dir, store.Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := os.Stat(first); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("leftover segment wasn't cleaned up. got %v", err)
+	}
+}
+
+// inserts and queries keep going while compaction writes, and nothing gets lost on the way
+func TestCompactConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	s, err := store.Open(dir, store.Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			err := s.Compact()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		err := s.Insert("BTC", i, i%2*20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Query("BTC", 0, i)
+	}
+	<-done
+	s.Close()
+
+	s, err = store.Open(dir, store.Reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b := new(bytes.Buffer)
+	s.Export(b, "BTC")
+	lines := strings.Count(b.String(), "\n")
+	if lines != 2001 {
+		t.Fatalf("wrong number of lines exported. expected %v got %v", 2001, lines)
+	}
+	out, _ := s.Query("BTC", 0, 2000)
+	if out != 10 {
+		t.Fatalf("wrong mean. expected %v got %v", 10, out)
+	}
+}
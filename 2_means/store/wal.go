@@ -0,0 +1,137 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Write ahead log for the inserts that are not in a segment yet.
+//
+// Each log belongs to one generation. Once the memtable gets compacted into segment N,
+// wal N is not needed anymore and the store moves on to wal N+1.
+//
+// Record layout:
+//
+//	symbol length (1) | symbol | timestamp int32 | price int32
+type wal struct {
+	id int
+	f  *os.File
+}
+
+func walName(id int) string {
+	return fmt.Sprintf("wal-%06d.log", id)
+}
+
+// replays every complete record in the log.
+// a half written record at the tail (crashed mid write) is ignored.
+// returns the size of the log up to the last complete record.
+func replayWal(path string, fn func(symbol string, p Price)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var size int64
+	for {
+		symbol, p, n, err := readRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return size, nil
+			}
+			return size, err
+		}
+		fn(symbol, p)
+		size += int64(n)
+	}
+}
+
+// open the log for appending.
+// anything after size is thrown away.
+func openWal(dir string, id int, size int64) (*wal, error) {
+	f, err := os.OpenFile(filepath.Join(dir, walName(id)), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	_, err = f.Seek(size, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wal{
+		id: id,
+		f:  f,
+	}, nil
+}
+
+func (w *wal) append(symbol string, p Price) error {
+	_, err := w.f.Write(encodeRecord(symbol, p))
+	return err
+}
+
+func (w *wal) sync() error {
+	return w.f.Sync()
+}
+
+func (w *wal) close() error {
+	err := w.f.Sync()
+	w.f.Close()
+	return err
+}
+
+// close and delete the log
+func (w *wal) remove() error {
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+func encodeRecord(symbol string, p Price) []byte {
+	b := make([]byte, 0, 1+len(symbol)+8)
+	b = append(b, byte(len(symbol)))
+	b = append(b, symbol...)
+	b = binary.BigEndian.AppendUint32(b, uint32(int32(p.Timestamp)))
+	b = binary.BigEndian.AppendUint32(b, uint32(int32(p.Price)))
+	return b
+}
+
+// returns the number of bytes read alongside the record
+func readRecord(r io.Reader) (string, Price, int, error) {
+	var p Price
+
+	l := make([]byte, 1)
+	_, err := io.ReadFull(r, l)
+	if err != nil {
+		return "", p, 0, err
+	}
+
+	b := make([]byte, int(l[0])+8)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return "", p, 0, io.ErrUnexpectedEOF
+	}
+
+	symbol := string(b[:l[0]])
+	p = decodePrice(b[l[0]:])
+	return symbol, p, 1 + len(b), nil
+}
+
+func decodePrice(b []byte) Price {
+	return Price{
+		Timestamp: int(int32(binary.BigEndian.Uint32(b[0:4]))),
+		Price:     int(int32(binary.BigEndian.Uint32(b[4:8]))),
+	}
+}
@@ -1,15 +1,91 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net"
+	"net/http"
+	"os"
 	"strings"
-	"sync"
+	"time"
 )
 
 func main() {
+	queueSize := flag.Int("queue", defaultQueueSize, "lines queued per member before they count as slow")
+	slow := flag.String("slow", "drop", "what to do with slow members. drop (oldest line) or disconnect")
+	historySize := flag.Int("history", defaultHistorySize, "lines of history kept per room")
+	historyReplay := flag.Int("replay", defaultHistoryReplay, "lines of history sent to newcomers")
+	transcriptPath := flag.String("transcript", "", "log everything said to this file. disabled if empty")
+	transcriptSize := flag.Int64("transcript-size", 10<<20, "rotate the transcript once it gets this big, in bytes")
+	transcriptKeep := flag.Int("transcript-keep", 5, "rotated transcripts to keep around")
+	operPassword := flag.String("oper-password", "", "password for /oper. operators are disabled if empty")
+	banFile := flag.String("bans", "bans.txt", "where bans are persisted")
+	auditPath := flag.String("audit", "", "log moderation actions to this file instead of stderr")
+	floodLimit := flag.Int("flood-limit", 5, "lines allowed per -flood-window before warning, then muting. 0 disables it")
+	floodWindow := flag.Duration("flood-window", 5*time.Second, "window for -flood-limit")
+	floodMute := flag.Duration("flood-mute", time.Minute, "how long flooders get muted for")
+	wsAddr := flag.String("ws", ":8080", "address for the websocket gateway, served at /chat. disabled if empty")
+	wsOrigins := flag.String("ws-origins", "", "comma separated origins allowed to open a websocket besides the gateway's own host")
+	ircAddr := flag.String("irc", ":6667", "address for the IRC listener. disabled if empty")
+	serverName := flag.String("name", "", "name of this server, shown after the names of our members on linked servers")
+	linkSecret := flag.String("link-secret", "", "secret shared by every linked server")
+	linkAddr := flag.String("link", "", "address to accept links from other servers on. disabled if empty")
+	peers := flag.String("peers", "", "comma separated addresses of servers to link to")
+	flag.Parse()
+
+	bans, err := loadBans(*banFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := Config{
+		QueueSize:     *queueSize,
+		HistorySize:   *historySize,
+		HistoryReplay: *historyReplay,
+		OperPassword:  *operPassword,
+		Bans:          bans,
+		FloodLimit:    *floodLimit,
+		FloodWindow:   *floodWindow,
+		FloodMute:     *floodMute,
+		ServerName:    *serverName,
+		LinkSecret:    *linkSecret,
+	}
+	if *wsOrigins != "" {
+		cfg.WSOrigins = strings.Split(*wsOrigins, ",")
+	}
+	switch *slow {
+	case "drop":
+		cfg.SlowPolicy = DropOldest
+	case "disconnect":
+		cfg.SlowPolicy = Disconnect
+	default:
+		log.Fatalf("unknown slow policy %v", *slow)
+	}
+
+	if *transcriptPath != "" {
+		ts, err := openTranscript(*transcriptPath, *transcriptSize, *transcriptKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ts.Close()
+		cfg.Transcript = ts
+	}
+
+	if *auditPath != "" {
+		f, err := os.OpenFile(*auditPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		cfg.Audit = f
+	}
+
+	if (*linkAddr != "" || *peers != "") && (*serverName == "" || *linkSecret == "") {
+		log.Fatal("linking needs both -name and -link-secret")
+	}
+
 	addr := ":8000"
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -18,17 +94,67 @@ func main() {
 
 	log.Println("Server listening at " + addr)
 
-	ch := MakeChatroom()
+	s := MakeServer(cfg)
 
 	defer ln.Close()
 
+	if *wsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/chat", s.handleWebSocket)
+		go func() {
+			log.Println("Websocket gateway listening at " + *wsAddr + "/chat")
+			err := http.ListenAndServe(*wsAddr, mux)
+			if err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if *ircAddr != "" {
+		ircLn, err := net.Listen("tcp", *ircAddr)
+		if err != nil {
+			panic(err)
+		}
+		defer ircLn.Close()
+		log.Println("IRC listening at " + *ircAddr)
+
+		go func() {
+			for {
+				c, err := ircLn.Accept()
+				if err != nil {
+					panic(err)
+				}
+				log.Println(c.RemoteAddr(), "connected over irc")
+				go s.handleIRC(c)
+			}
+		}()
+	}
+
+	if *linkAddr != "" {
+		linkLn, err := net.Listen("tcp", *linkAddr)
+		if err != nil {
+			panic(err)
+		}
+		defer linkLn.Close()
+		log.Println("Accepting links at " + *linkAddr)
+
+		go s.ListenLinks(linkLn)
+	}
+
+	for _, peer := range strings.Split(*peers, ",") {
+		if peer == "" {
+			continue
+		}
+		go s.LinkTo(context.Background(), peer)
+	}
+
 	for {
 		c, err := ln.Accept()
 		if err != nil {
 			panic(err)
 		}
 		log.Println(c.RemoteAddr(), "connected")
-		go ch.handleConnection(c)
+		go s.handleConnection(c)
 	}
 }
 
@@ -52,129 +178,53 @@ func validateName(s string) bool {
 	return true
 }
 
-func (ch *Chatroom) handleConnection(c net.Conn) {
+func (s *Server) handleConnection(c net.Conn) {
 	defer c.Close()
 
-	m := &Member{
-		conn: c,
+	m := MakeMember(c, s.cfg.QueueSize, s.cfg.SlowPolicy)
+	defer m.Close()
+
+	if s.bans.bannedIP(m.ip()) {
+		m.Send("Sorry, you are banned. Disconnecting now...\n")
+		return
 	}
 
 	m.Send("Welcome to budgetchat! What shall I call you?\n")
-	name := m.Recv()
+	name, _ := m.Recv()
 	if !validateName(name) {
 		m.Send("Sorry, your name is invalid. Disconnecting now...\n")
 		return
 	}
 	m.name = name
 
-	ch.AddUser(m)
-	defer ch.RemoveUser(m)
-
-	sc := bufio.NewScanner(c)
-	for sc.Scan() {
-		msg := sc.Text()
-		ch.SendMessage(m, msg)
+	err := s.Register(m)
+	if errors.Is(err, ErrBanned) {
+		m.Send("Sorry, you are banned. Disconnecting now...\n")
+		return
 	}
-}
-
-type Member struct {
-	conn net.Conn
-	name string
-}
-
-func (m *Member) Send(s string) {
-	m.conn.Write([]byte(s))
-}
-
-func (m *Member) Recv() string {
-	sc := bufio.NewScanner(m.conn)
-	for sc.Scan() {
-		return sc.Text()
+	if err != nil {
+		m.Send("Sorry, that name is taken. Disconnecting now...\n")
+		return
 	}
-	return ""
-}
+	defer s.Unregister(m)
 
-type Chatroom struct {
-	members []*Member
-	mu      sync.Mutex
-}
-
-func MakeChatroom() *Chatroom {
-	return &Chatroom{
-		members: make([]*Member, 0),
+	err = s.Join(m, defaultRoom)
+	if err != nil {
+		return
 	}
-}
 
-func (ch *Chatroom) broadcast(msg string, exception ...*Member) {
-	// turn this into a map if performance is bad
-	inException := func(toCheck *Member) bool {
-		for _, member := range exception {
-			if member == toCheck {
-				return true
-			}
+	for {
+		msg, ok := m.Recv()
+		if !ok {
+			return
 		}
-		return false
-	}
-
-	for _, m := range ch.members {
-		if inException(m) {
+		if isCommand(msg) {
+			s.handleCommand(m, msg)
 			continue
 		}
-		m.Send(msg)
-	}
-}
-
-func (ch *Chatroom) SendMessage(sender *Member, msg string) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-
-	msgFormatted := fmt.Sprintf("[%v] %v\n", sender.name, msg)
-	ch.broadcast(msgFormatted, sender)
-}
-
-func (ch *Chatroom) AddUser(m *Member) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-
-	m.Send(ch.userList())
-	enterMsg := fmt.Sprintf("* %v has entered the room\n", m.name)
-	ch.broadcast(enterMsg)
-
-	ch.members = append(ch.members, m)
-	log.Println(enterMsg)
-}
-
-func (ch *Chatroom) RemoveUser(m *Member) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-
-	leaveMsg := fmt.Sprintf("* %v has left the room\n", m.name)
-	ch.broadcast(leaveMsg, m)
-	ch.members = Remove(ch.members, m)
-	log.Println(leaveMsg)
-}
-
-func (ch *Chatroom) userList() string {
-	members := make([]string, 0)
-	for _, c := range ch.members {
-		members = append(members, c.name)
-	}
-	members_string := strings.Join(members, ", ")
-
-	return "* The room contains: " + members_string + "\n"
-}
-
-func Remove[T comparable](s []T, elem T) []T {
-	for i, c := range s {
-		if c != elem {
+		if !s.canSpeak(m) {
 			continue
 		}
-
-		var after []T
-		if len(s) > i+1 {
-			after = s[i+1:]
-		}
-		return append(s[:i], after...)
+		m.room.SendMessage(m, msg)
 	}
-	return s
 }
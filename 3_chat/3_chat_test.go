@@ -1,7 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNameValidate(t *testing.T) {
@@ -32,3 +42,505 @@ func TestNameValidate(t *testing.T) {
 		}
 	}
 }
+
+// records everything written to it
+type recordConn struct {
+	net.Conn
+	b  bytes.Buffer
+	mu sync.Mutex
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.b.Write(b)
+}
+
+func (c *recordConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1337}
+}
+
+func (c *recordConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+// members write in the background.
+// waits until enough got written, then checks and forgets all of it.
+func (c *recordConn) expect(t *testing.T, want string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		got := c.b.String()
+		if len(got) >= len(want) || time.Now().After(deadline) {
+			c.b.Reset()
+			c.mu.Unlock()
+			if got != want {
+				t.Fatalf("wrong output. expected %q got %q", want, got)
+			}
+			return
+		}
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func makeTestMember(name string) (*Member, *recordConn) {
+	c := &recordConn{}
+	m := MakeMember(c, 0, DropOldest)
+	m.name = name
+	return m, c
+}
+
+func TestRooms(t *testing.T) {
+	s := MakeServer(Config{})
+
+	alice, aliceConn := makeTestMember("alice")
+	bob, bobConn := makeTestMember("bob")
+
+	s.Join(alice, defaultRoom)
+	s.Join(bob, defaultRoom)
+	aliceConn.expect(t, "* The room contains: \n* bob has entered the room\n")
+	bobConn.expect(t, "* The room contains: alice\n")
+
+	s.handleCommand(bob, "/join foo")
+	aliceConn.expect(t, "* bob has left the room\n")
+	bobConn.expect(t, "* The room contains: \n")
+
+	s.handleCommand(alice, "/rooms")
+	aliceConn.expect(t, "* Rooms: foo (1), general (1)\n")
+
+	// alice would get this before the enter notice if it leaked
+	bob.room.SendMessage(bob, "hi")
+	s.handleCommand(bob, "/leave")
+	aliceConn.expect(t, "* bob has entered the room\n")
+
+	s.handleCommand(alice, "/rooms")
+	aliceConn.expect(t, "* Rooms: general (2)\n")
+}
+
+func TestNames(t *testing.T) {
+	s := MakeServer(Config{})
+
+	alice, aliceConn := makeTestMember("alice")
+	bob, bobConn := makeTestMember("bob")
+	impostor, _ := makeTestMember("ALICE")
+
+	for _, m := range []*Member{alice, bob} {
+		if err := s.Register(m); err != nil {
+			t.Fatal(err)
+		}
+		s.Join(m, defaultRoom)
+	}
+	if err := s.Register(impostor); err != ErrNameTaken {
+		t.Fatalf("expected duplicate name to be rejected. got %v", err)
+	}
+	aliceConn.expect(t, "* The room contains: \n* bob has entered the room\n")
+	bobConn.expect(t, "* The room contains: alice\n")
+
+	s.handleCommand(alice, "/msg BOB psst")
+	bobConn.expect(t, "[alice -> bob] psst\n")
+
+	s.handleCommand(alice, "/nick bob")
+	aliceConn.expect(t, "* The name bob is taken\n")
+
+	s.handleCommand(alice, "/nick carol")
+	bobConn.expect(t, "* alice is now known as carol\n")
+
+	// the old name is free again
+	if err := s.Register(impostor); err != nil {
+		t.Fatalf("expected old name to be released. got %v", err)
+	}
+}
+
+// blocks every write until released, or until the write deadline passes
+type stallConn struct {
+	recordConn
+	stalled  chan struct{} // gets a value once a write is stuck
+	release  chan struct{}
+	closed   chan struct{}
+	deadline chan struct{} // closed once the write deadline passes
+	once     sync.Once
+}
+
+func makeStallConn() *stallConn {
+	return &stallConn{
+		stalled:  make(chan struct{}, 1),
+		release:  make(chan struct{}),
+		closed:   make(chan struct{}),
+		deadline: make(chan struct{}),
+	}
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	select {
+	case c.stalled <- struct{}{}:
+	default:
+	}
+	select {
+	case <-c.release:
+	case <-c.deadline:
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.recordConn.Write(b)
+}
+
+func (c *stallConn) SetWriteDeadline(t time.Time) error {
+	time.AfterFunc(time.Until(t), func() {
+		c.once.Do(func() { close(c.deadline) })
+	})
+	return nil
+}
+
+func (c *stallConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestSlowDropOldest(t *testing.T) {
+	c := makeStallConn()
+	m := MakeMember(c, 2, DropOldest)
+
+	m.Send("a\n")
+	<-c.stalled
+	m.Send("b\n")
+	m.Send("c\n")
+	m.Send("d\n") // pushes b out
+
+	close(c.release)
+	c.expect(t, "a\nc\nd\n")
+}
+
+// a client that stopped reading gets dropped without ever reading again,
+// whether it's too slow, kicked or just leaving
+func TestStalledDropped(t *testing.T) {
+	type stallCase struct {
+		name   string
+		policy SlowPolicy
+		drop   func(m *Member)
+	}
+
+	cases := []stallCase{
+		{"too slow", Disconnect, func(m *Member) {
+			m.Send("b\n")
+			m.Send("c\n")
+		}},
+		{"kicked", DropOldest, func(m *Member) {
+			m.Kick("bye")
+		}},
+		{"closed", DropOldest, func(m *Member) {
+			go m.Close()
+		}},
+	}
+
+	for _, tc := range cases {
+		c := makeStallConn()
+		m := MakeMember(c, 1, tc.policy)
+
+		m.Send("a\n")
+		<-c.stalled
+		tc.drop(m) // should not block either
+
+		select {
+		case <-c.closed:
+		case <-time.After(2 * flushTimeout):
+			t.Fatalf("%v: stalled member was not disconnected", tc.name)
+		}
+		select {
+		case <-m.finished:
+		case <-time.After(time.Second):
+			t.Fatalf("%v: writer never finished", tc.name)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := MakeServer(Config{
+		HistorySize:   3,
+		HistoryReplay: 2,
+	})
+	s.rooms[defaultRoom].history.now = func() time.Time {
+		return time.Date(2024, 1, 1, 13, 37, 0, 0, time.UTC)
+	}
+
+	alice, aliceConn := makeTestMember("alice")
+	bob, bobConn := makeTestMember("bob")
+
+	s.Join(alice, defaultRoom)
+	for _, msg := range []string{"one", "two", "three", "four"} {
+		alice.room.SendMessage(alice, msg)
+	}
+	aliceConn.expect(t, "* The room contains: \n")
+
+	s.Join(bob, defaultRoom)
+	bobConn.expect(t, "* The room contains: alice\n[13:37:00] [alice] three\n[13:37:00] [alice] four\n")
+
+	// only 3 fit in the buffer, the enter notice pushed out "two"
+	s.handleCommand(bob, "/history 10")
+	bobConn.expect(t, "[13:37:00] [alice] three\n[13:37:00] [alice] four\n[13:37:00] * bob has entered the room\n")
+}
+
+func TestTranscriptRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.log")
+	ts, err := openTranscript(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	at := time.Date(2024, 1, 1, 13, 37, 0, 0, time.UTC)
+	for _, text := range []string{"1", "2", "3", "4"} {
+		err := ts.write("general", entry{
+			at: at,
+			ev: event{kind: evMessage, from: "a", text: text},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "2024-01-01T13:37:00Z general [a] 4\n",
+		path + ".1": "2024-01-01T13:37:00Z general [a] 3\n",
+		path + ".2": "2024-01-01T13:37:00Z general [a] 2\n",
+	}
+	for p, exp := range expected {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != exp {
+			t.Fatalf("wrong content in %v. expected %q got %q", p, exp, b)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Fatalf("kept too many transcripts")
+	}
+}
+
+// a stuck disk can't hold up the room
+func TestTranscriptStalled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.log")
+	ts, err := openTranscript(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := MakeServer(Config{Transcript: ts})
+
+	alice, _ := makeTestMember("alice")
+	bob, bobConn := makeTestMember("bob")
+	s.Join(alice, defaultRoom)
+	s.Join(bob, defaultRoom)
+	bobConn.expect(t, "* The room contains: alice\n")
+
+	// the writer waits on this, same as on a slow write
+	ts.mu.Lock()
+	sent := make(chan struct{})
+	go func() {
+		alice.room.SendMessage(alice, "hi")
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("message stuck behind the transcript")
+	}
+	bobConn.expect(t, "[alice] hi\n")
+	ts.mu.Unlock()
+
+	ts.Close()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(b), "general [alice] hi\n") {
+		t.Fatalf("wrong transcript. expected it to end with the message got %q", b)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	banFile := filepath.Join(t.TempDir(), "bans.txt")
+	bans, err := loadBans(banFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := MakeServer(Config{
+		OperPassword: "hunter2",
+		Bans:         bans,
+		Audit:        io.Discard,
+	})
+
+	alice, aliceConn := makeTestMember("alice")
+	bob, bobConn := makeTestMember("bob")
+	for _, m := range []*Member{alice, bob} {
+		s.Register(m)
+		s.Join(m, defaultRoom)
+	}
+	aliceConn.expect(t, "* The room contains: \n* bob has entered the room\n")
+	bobConn.expect(t, "* The room contains: alice\n")
+
+	s.handleCommand(alice, "/kick bob")
+	aliceConn.expect(t, "* You need to be an operator for /kick\n")
+
+	s.handleCommand(alice, "/oper hunter3")
+	aliceConn.expect(t, "* Wrong password\n")
+	s.handleCommand(alice, "/oper hunter2")
+	aliceConn.expect(t, "* alice is now an operator\n")
+	bobConn.expect(t, "* alice is now an operator\n")
+
+	s.handleCommand(alice, "/mute bob 1m")
+	aliceConn.expect(t, "* bob was muted for 1m0s by alice\n")
+	bobConn.expect(t, "* bob was muted for 1m0s by alice\n")
+	if s.canSpeak(bob) {
+		t.Fatalf("muted member can still speak")
+	}
+	bobConn.expect(t, "* You are muted for another 1m0s\n")
+
+	s.handleCommand(alice, "/ban BOB")
+	aliceConn.expect(t, "* bob was banned by alice\n* Banned BOB\n")
+	bobConn.expect(t, "* bob was banned by alice\n")
+	s.Unregister(bob)
+	aliceConn.expect(t, "* bob has left the room\n")
+
+	s.handleCommand(alice, "/unban BOB")
+	aliceConn.expect(t, "* BOB was unbanned by alice\n* Unbanned BOB\n")
+	s.handleCommand(alice, "/ban bob")
+	aliceConn.expect(t, "* Banned bob\n")
+
+	// survives a restart
+	bans, err = loadBans(banFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = MakeServer(Config{
+		Bans:  bans,
+		Audit: io.Discard,
+	})
+	bob, _ = makeTestMember("bob")
+	if err := s.Register(bob); err != ErrBanned {
+		t.Fatalf("expected banned name to be rejected. got %v", err)
+	}
+}
+
+// password guesses count towards the flood limit like any line
+func TestOperFlood(t *testing.T) {
+	s := MakeServer(Config{
+		OperPassword: "hunter2",
+		Audit:        io.Discard,
+		FloodLimit:   2,
+		FloodWindow:  time.Minute,
+		FloodMute:    time.Minute,
+	})
+
+	mallory, malloryConn := makeTestMember("mallory")
+	s.Register(mallory)
+	s.Join(mallory, defaultRoom)
+	malloryConn.expect(t, "* The room contains: \n")
+
+	for _, guess := range []string{"a", "b", "c", "d", "hunter2"} {
+		s.handleCommand(mallory, "/oper "+guess)
+	}
+	malloryConn.expect(t, "* Wrong password\n* Wrong password\n"+
+		"* You are sending messages too fast. Slow down or you will be muted.\n"+
+		"* mallory was muted for 1m0s for flooding\n"+
+		"* You are muted for another 1m0s\n")
+	if mallory.oper {
+		t.Fatalf("got to be an operator while muted")
+	}
+}
+
+func TestFlood(t *testing.T) {
+	s := MakeServer(Config{
+		Audit:       io.Discard,
+		FloodLimit:  2,
+		FloodWindow: time.Minute,
+		FloodMute:   time.Minute,
+	})
+
+	alice, aliceConn := makeTestMember("alice")
+	s.Register(alice)
+	s.Join(alice, defaultRoom)
+	aliceConn.expect(t, "* The room contains: \n")
+
+	expected := []bool{true, true, false, false, false}
+	for i, exp := range expected {
+		if out := s.canSpeak(alice); out != exp {
+			t.Fatalf("wrong flood verdict for line %v. expected %v got %v", i, exp, out)
+		}
+	}
+	aliceConn.expect(t, "* You are sending messages too fast. Slow down or you will be muted.\n"+
+		"* alice was muted for 1m0s for flooding\n"+
+		"* You are muted for another 1m0s\n")
+}
+
+// waits until the connection got n lines, then returns them
+func (c *recordConn) lines(t *testing.T, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		got := strings.Split(strings.TrimSuffix(c.b.String(), "\n"), "\n")
+		c.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong number of lines. expected %v got %v", n, len(got))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// everyone sees messages in the same order, and a newcomer always sees the room list first
+func TestOrdering(t *testing.T) {
+	room := MakeChatroom(defaultRoom, 1000, 0, nil)
+	member := func(name string) (*Member, *recordConn) {
+		c := &recordConn{}
+		m := MakeMember(c, 1000, DropOldest)
+		m.name = name
+		return m, c
+	}
+
+	alice, aliceConn := member("alice")
+	bob, bobConn := member("bob")
+	carol, _ := member("carol")
+	dave, _ := member("dave")
+	eve, eveConn := member("eve")
+	for _, m := range []*Member{alice, bob, carol, dave} {
+		room.AddUser(m)
+	}
+	// the room lists and everyone after them entering
+	aliceConn.expect(t, "* The room contains: \n* bob has entered the room\n* carol has entered the room\n* dave has entered the room\n")
+	bobConn.expect(t, "* The room contains: alice\n* carol has entered the room\n* dave has entered the room\n")
+
+	var wg sync.WaitGroup
+	for _, m := range []*Member{carol, dave} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				room.SendMessage(m, strconv.Itoa(i))
+			}
+		}()
+	}
+	room.AddUser(eve)
+	wg.Wait()
+
+	got := bobConn.lines(t, 201)
+	expected := aliceConn.lines(t, 201)
+	if !slices.Equal(got, expected) {
+		t.Fatalf("members saw different orders. expected %q got %q", expected, got)
+	}
+	first := eveConn.lines(t, 1)[0]
+	if !strings.HasPrefix(first, "* The room contains: ") {
+		t.Fatalf("wrong first line for newcomer. expected the room list got %q", first)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNameTaken = fmt.Errorf("name is taken")
+)
+
+type Chatroom struct {
+	name    string
+	members []*Member
+	mu      sync.Mutex
+
+	history    *history
+	replay     int         // history lines sent to newcomers
+	transcript *transcript // can be nil
+
+	// called with everything local members do here, so it can be passed on to linked servers.
+	// can be nil.
+	relay func(ev event)
+}
+
+func MakeChatroom(name string, historySize int, replay int, ts *transcript) *Chatroom {
+	return &Chatroom{
+		name:       name,
+		members:    make([]*Member, 0),
+		history:    makeHistory(historySize),
+		replay:     replay,
+		transcript: ts,
+	}
+}
+
+// records the event in the history, then sends it to everyone in the room.
+// it all happens under the lock, so everyone sees events in the same order the history has them.
+// sending and the transcript only queue, so that's cheap.
+// don't hold the lock while calling this.
+func (ch *Chatroom) broadcast(ev event, exception ...*Member) {
+	// turn this into a map if performance is bad
+	inException := func(toCheck *Member) bool {
+		for _, member := range exception {
+			if member == toCheck {
+				return true
+			}
+		}
+		return false
+	}
+
+	ev.room = ch.name
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.history.add(ev)
+	if ch.transcript != nil {
+		ch.transcript.add(ch.name, ch.history.last(1)[0])
+	}
+
+	for _, m := range ch.members {
+		if inException(m) {
+			continue
+		}
+		m.Deliver(ev)
+	}
+}
+
+func (ch *Chatroom) SendMessage(sender *Member, msg string) {
+	ev := event{
+		kind: evMessage,
+		from: sender.name,
+		text: msg,
+	}
+	ch.broadcast(ev, sender)
+	ch.relayFrom(sender, ev)
+}
+
+// only what happens to our own members gets relayed.
+// whatever remote members do was relayed by their own server already.
+func (ch *Chatroom) relayFrom(m *Member, ev event) {
+	if ch.relay == nil || m.remote != "" {
+		return
+	}
+	ev.room = ch.name
+	ch.relay(ev)
+}
+
+// names are unique within the room, ignoring case
+func (ch *Chatroom) AddUser(m *Member) error {
+	ch.mu.Lock()
+	if ch.find(m.name) != nil {
+		ch.mu.Unlock()
+		return ErrNameTaken
+	}
+	// queued before they're in the room, so nothing said in it can get ahead of the room list
+	m.Deliver(event{
+		kind:  evEntered,
+		room:  ch.name,
+		names: ch.names(),
+	})
+	for _, e := range ch.history.last(ch.replay) {
+		m.Deliver(e.event())
+	}
+	ch.members = append(ch.members, m)
+	ch.mu.Unlock()
+
+	enter := event{
+		kind: evJoin,
+		from: m.name,
+	}
+	ch.broadcast(enter, m)
+	ch.relayFrom(m, enter)
+	log.Printf("[%v] %v", ch.name, enter)
+	return nil
+}
+
+func (ch *Chatroom) RemoveUser(m *Member) {
+	ch.mu.Lock()
+	ch.members = Remove(ch.members, m)
+	ch.mu.Unlock()
+
+	leave := event{
+		kind: evLeave,
+		from: m.name,
+	}
+	ch.broadcast(leave)
+	ch.relayFrom(m, leave)
+	log.Printf("[%v] %v", ch.name, leave)
+}
+
+// renames the member and lets the room know, the member included.
+func (ch *Chatroom) Rename(m *Member, name string) error {
+	ch.mu.Lock()
+	if other := ch.find(name); other != nil && other != m {
+		ch.mu.Unlock()
+		return ErrNameTaken
+	}
+	rename := event{
+		kind: evRename,
+		from: m.name,
+		to:   name,
+	}
+	m.name = name
+	ch.mu.Unlock()
+
+	ch.broadcast(rename)
+	ch.relayFrom(m, rename)
+	log.Printf("[%v] %v", ch.name, rename)
+	return nil
+}
+
+func (ch *Chatroom) find(name string) *Member {
+	for _, m := range ch.members {
+		if strings.EqualFold(m.name, name) {
+			return m
+		}
+	}
+	return nil
+}
+
+// last n lines said in the room
+func (ch *Chatroom) History(n int) []entry {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.history.last(n)
+}
+
+// names of everyone in the room, including whoever asked for it
+func (ch *Chatroom) Who() []string {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.names()
+}
+
+func (ch *Chatroom) Len() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return len(ch.members)
+}
+
+func (ch *Chatroom) names() []string {
+	members := make([]string, 0)
+	for _, c := range ch.members {
+		members = append(members, c.name)
+	}
+	return members
+}
+
+func Remove[T comparable](s []T, elem T) []T {
+	for i, c := range s {
+		if c != elem {
+			continue
+		}
+
+		var after []T
+		if len(s) > i+1 {
+			after = s[i+1:]
+		}
+		return append(s[:i], after...)
+	}
+	return s
+}
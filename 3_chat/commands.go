@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lines starting with a slash are commands instead of chat messages
+func isCommand(line string) bool {
+	return strings.HasPrefix(line, "/")
+}
+
+func (s *Server) handleCommand(m *Member, line string) {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch cmd {
+	case "/join":
+		if !validateName(arg) {
+			m.Notice("Usage: /join <room>. Room names are alphanumeric.")
+			return
+		}
+		if m.room != nil && m.room.name == arg {
+			m.Notice("You are already in " + arg)
+			return
+		}
+		s.Join(m, arg)
+
+	case "/leave":
+		if m.room != nil && m.room.name == defaultRoom {
+			m.Notice("You are already in " + defaultRoom)
+			return
+		}
+		s.Join(m, defaultRoom)
+
+	case "/rooms":
+		m.Notice(s.roomList())
+
+	case "/who":
+		m.Deliver(event{
+			kind:  evNames,
+			room:  m.room.name,
+			names: m.room.Who(),
+		})
+
+	case "/history":
+		n := defaultHistorySize
+		if arg != "" {
+			var err error
+			n, err = strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				m.Notice("Usage: /history [n]")
+				return
+			}
+		}
+		for _, e := range m.room.History(n) {
+			m.Deliver(e.event())
+		}
+
+	case "/msg":
+		to, msg, _ := strings.Cut(arg, " ")
+		if to == "" || msg == "" {
+			m.Notice("Usage: /msg <name> <text>")
+			return
+		}
+		if !s.canSpeak(m) {
+			return
+		}
+		err := s.Whisper(m, to, msg)
+		if err != nil {
+			m.Notice("No one here is called " + to)
+		}
+
+	case "/nick":
+		if !validateName(arg) {
+			m.Notice("Usage: /nick <name>. Names are alphanumeric.")
+			return
+		}
+		err := s.Rename(m, arg)
+		if errors.Is(err, ErrBanned) {
+			m.Notice("The name " + arg + " is banned")
+		} else if err != nil {
+			m.Notice("The name " + arg + " is taken")
+		}
+
+	case "/oper":
+		// guessing the password counts as flooding too
+		if !s.canSpeak(m) {
+			return
+		}
+		if !s.Oper(m, arg) {
+			m.Notice("Wrong password")
+		}
+
+	case "/kick", "/mute", "/ban", "/unban":
+		if !m.oper {
+			m.Notice("You need to be an operator for " + cmd)
+			return
+		}
+		s.handleOperCommand(m, cmd, arg)
+
+	default:
+		m.Notice("Unknown command " + cmd)
+	}
+}
+
+func (s *Server) handleOperCommand(m *Member, cmd string, arg string) {
+	switch cmd {
+	case "/kick":
+		err := s.Kick(m, arg)
+		if errors.Is(err, ErrRemoteMember) {
+			m.Notice(arg + " is on another server")
+		} else if err != nil {
+			m.Notice("No one here is called " + arg)
+		}
+
+	case "/mute":
+		name, dur, _ := strings.Cut(arg, " ")
+		d, err := time.ParseDuration(dur)
+		if name == "" || err != nil || d <= 0 {
+			m.Notice("Usage: /mute <name> <duration>, like /mute bob 5m")
+			return
+		}
+		err = s.Mute(m, name, d)
+		if errors.Is(err, ErrRemoteMember) {
+			m.Notice(name + " is on another server")
+		} else if err != nil {
+			m.Notice("No one here is called " + name)
+		}
+
+	case "/ban":
+		if arg == "" {
+			m.Notice("Usage: /ban <name or ip>")
+			return
+		}
+		err := s.Ban(m, arg)
+		if err != nil {
+			m.Notice("Failed to save the ban: " + err.Error())
+			return
+		}
+		m.Notice("Banned " + arg)
+
+	case "/unban":
+		ok, err := s.Unban(m, arg)
+		if err != nil {
+			m.Notice("Failed to save the ban list: " + err.Error())
+			return
+		}
+		if !ok {
+			m.Notice(arg + " was not banned")
+			return
+		}
+		m.Notice("Unbanned " + arg)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type eventKind int
+
+const (
+	// [from] text
+	evMessage eventKind = iota
+	// from joined the room
+	evJoin
+	// from left the room
+	evLeave
+	// from is now called to
+	evRename
+	// sent to whoever just joined the room, names are everyone else in it
+	evEntered
+	// everyone in the room, names included
+	evNames
+	// text from, well, from. only for to.
+	evPrivate
+	// anything else the server has to say
+	evNotice
+	// a line out of the room history, text is already formatted
+	evHistory
+)
+
+// Something that happened in the chat.
+// Every kind of client formats these its own way.
+type event struct {
+	kind  eventKind
+	room  string
+	from  string
+	to    string
+	text  string
+	names []string
+}
+
+// the plain budget chat format
+func (e event) String() string {
+	switch e.kind {
+	case evMessage:
+		return fmt.Sprintf("[%v] %v\n", e.from, e.text)
+	case evJoin:
+		return fmt.Sprintf("* %v has entered the room\n", e.from)
+	case evLeave:
+		return fmt.Sprintf("* %v has left the room\n", e.from)
+	case evRename:
+		return fmt.Sprintf("* %v is now known as %v\n", e.from, e.to)
+	case evEntered, evNames:
+		return "* The room contains: " + strings.Join(e.names, ", ") + "\n"
+	case evPrivate:
+		return fmt.Sprintf("[%v -> %v] %v\n", e.from, e.to, e.text)
+	case evHistory:
+		return e.text
+	default:
+		return "* " + e.text + "\n"
+	}
+}
+
+// turns events into lines for a specific kind of client
+type formatter interface {
+	format(e event) string
+}
+
+type nativeFormatter struct{}
+
+func (nativeFormatter) format(e event) string {
+	return e.String()
+}
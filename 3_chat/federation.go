@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLinkAuth      = fmt.Errorf("link authentication failed")
+	ErrLinkDuplicate = fmt.Errorf("already linked to that server")
+	ErrRemoteMember  = fmt.Errorf("member is on another server")
+)
+
+const (
+	linkQueueSize        = 1024
+	linkHandshakeTimeout = 10 * time.Second
+	linkMaxBackoff       = 30 * time.Second
+)
+
+// One line of JSON on a server to server link.
+//
+// A link starts with both sides sending a hello with a random nonce,
+// then both sides answer the other's nonce with an auth.
+// The mac is HMAC-SHA256 of the nonce and the sender's name, keyed with the shared secret.
+//
+// After that each side sends a burst of every member it knows about,
+// followed by events as they happen.
+type linkMsg struct {
+	Type string `json:"type"` // hello, auth, burst or event
+
+	Server string `json:"server,omitempty"`
+	Nonce  string `json:"nonce,omitempty"`
+	Mac    string `json:"mac,omitempty"`
+
+	// where the event originally happened.
+	// events from an origin are numbered, epoch changes whenever that server restarts.
+	Origin string `json:"origin,omitempty"`
+	Epoch  int64  `json:"epoch,omitempty"`
+	Seq    uint64 `json:"seq,omitempty"`
+
+	Kind string `json:"kind,omitempty"` // join, leave, rename, message or private
+	Room string `json:"room,omitempty"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+var linkKinds = map[eventKind]string{
+	evMessage: "message",
+	evJoin:    "join",
+	evLeave:   "leave",
+	evRename:  "rename",
+}
+
+type link struct {
+	peer string // name of the server on the other side
+	c    net.Conn
+	out  chan linkMsg
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *link) send(msg linkMsg) {
+	select {
+	case l.out <- msg:
+	case <-l.done:
+	default:
+		// can't keep up. better to netsplit and resync on the next link.
+		log.Printf("link to %v is too slow, dropping it", l.peer)
+		l.close()
+	}
+}
+
+func (l *link) close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.c.Close()
+	})
+}
+
+func (l *link) writeLoop() {
+	enc := json.NewEncoder(l.c)
+	for {
+		select {
+		case msg := <-l.out:
+			err := enc.Encode(msg)
+			if err != nil {
+				l.close()
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Links this server up with other budget chat servers.
+// Everything said here gets relayed to them, and the other way around.
+type federation struct {
+	links map[string]*link // by peer name
+	epoch int64
+	seq   uint64
+	seen  map[string]seenOrigin // last event we got from each origin
+	mu    sync.Mutex            // leaf lock, never held while taking another one
+}
+
+type seenOrigin struct {
+	epoch int64
+	seq   uint64
+}
+
+func makeFederation() *federation {
+	return &federation{
+		links: make(map[string]*link),
+		epoch: time.Now().UnixNano(),
+		seen:  make(map[string]seenOrigin),
+	}
+}
+
+// false if we already got this event through another link.
+// every link delivers an origin's events in order, so the highest sequence number is enough.
+func (f *federation) firstTime(msg linkMsg) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	last, ok := f.seen[msg.Origin]
+	if ok && last.epoch == msg.Epoch && msg.Seq <= last.seq {
+		return false
+	}
+	f.seen[msg.Origin] = seenOrigin{
+		epoch: msg.Epoch,
+		seq:   msg.Seq,
+	}
+	return true
+}
+
+// sends the message to every link but the one it came from
+func (f *federation) forward(msg linkMsg, except *link) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, l := range f.links {
+		if l != except {
+			l.send(msg)
+		}
+	}
+}
+
+func (s *Server) linkName(name string) string {
+	return name + "@" + s.cfg.ServerName
+}
+
+// relays an event that happened here to every linked server.
+// names of local members get our server name tacked on.
+func (s *Server) relayLocal(ev event) {
+	kind, ok := linkKinds[ev.kind]
+	if !ok || s.cfg.ServerName == "" {
+		return
+	}
+
+	msg := linkMsg{
+		Type: "event",
+		Kind: kind,
+		Room: ev.room,
+		From: s.linkName(ev.from),
+		To:   ev.to,
+		Text: ev.text,
+	}
+	if ev.kind == evRename {
+		msg.To = s.linkName(ev.to)
+	}
+	s.relay(msg)
+}
+
+// relays an event about a member that is already fully named
+func (s *Server) relay(msg linkMsg) {
+	s.relayVia(msg, nil)
+}
+
+// relays an event on just the one link, every link if it's nil.
+// the sequence number is handed out and the message queued under the same lock,
+// otherwise two sends can overtake each other and firstTime drops the earlier one.
+func (s *Server) relayVia(msg linkMsg, via *link) {
+	f := s.fed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	msg.Origin = s.cfg.ServerName
+	msg.Epoch = f.epoch
+	msg.Seq = f.seq
+
+	if via != nil {
+		via.send(msg)
+		return
+	}
+	for _, l := range f.links {
+		l.send(msg)
+	}
+}
+
+// passes a private message that isn't for us on towards the server the recipient is on
+func (s *Server) routePrivate(msg linkMsg, from *link) {
+	s.mu.Lock()
+	target := s.names[strings.ToLower(msg.To)]
+	s.mu.Unlock()
+
+	if target == nil || target.via == nil || target.via == from {
+		return
+	}
+	target.via.send(msg)
+}
+
+// accepts links from other servers until the listener is closed
+func (s *Server) ListenLinks(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			err := s.runLink(c)
+			if err != nil {
+				log.Printf("link from %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// keeps a link to the server at addr up, redialing with backoff whenever it drops.
+// returns once the context is done.
+func (s *Server) LinkTo(ctx context.Context, addr string) {
+	backoff := time.Second
+	for {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			stop := context.AfterFunc(ctx, func() {
+				c.Close()
+			})
+			start := time.Now()
+			err = s.runLink(c)
+			stop()
+			// it was up for a while, so start the backoff over
+			if time.Since(start) > linkMaxBackoff {
+				backoff = time.Second
+			}
+		}
+		log.Printf("link to %v: %v. retrying in %v", addr, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, linkMaxBackoff)
+	}
+}
+
+// handshakes, then relays until the link drops
+func (s *Server) runLink(c net.Conn) error {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(c)
+
+	c.SetDeadline(time.Now().Add(linkHandshakeTimeout))
+	peer, err := s.linkHandshake(dec, enc)
+	if err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+
+	l := &link{
+		peer: peer,
+		c:    c,
+		out:  make(chan linkMsg, linkQueueSize),
+		done: make(chan struct{}),
+	}
+	defer l.close()
+
+	f := s.fed
+	f.mu.Lock()
+	if f.links[peer] != nil {
+		f.mu.Unlock()
+		return ErrLinkDuplicate
+	}
+	f.links[peer] = l
+	f.mu.Unlock()
+
+	go l.writeLoop()
+	log.Printf("linked with %v", peer)
+
+	s.netjoin(l)
+	defer s.netsplit(l)
+
+	for {
+		var msg linkMsg
+		err := dec.Decode(&msg)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case "burst":
+			// pass new members on, so servers further down learn about them too.
+			// ones everybody knows already stop here, which keeps bursts from going round in circles.
+			if s.applyJoin(l, msg) {
+				f.forward(msg, l)
+			}
+		case "event":
+			if msg.Origin == s.cfg.ServerName || !f.firstTime(msg) {
+				continue
+			}
+			s.applyRemote(l, msg)
+			if msg.Kind == "private" {
+				s.routePrivate(msg, l)
+			} else {
+				f.forward(msg, l)
+			}
+		}
+	}
+}
+
+func (s *Server) linkHandshake(dec *json.Decoder, enc *json.Encoder) (string, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	ours := hex.EncodeToString(nonce)
+
+	err := enc.Encode(linkMsg{
+		Type:   "hello",
+		Server: s.cfg.ServerName,
+		Nonce:  ours,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var hello linkMsg
+	err = dec.Decode(&hello)
+	if err != nil {
+		return "", err
+	}
+	if hello.Type != "hello" || hello.Server == "" || hello.Server == s.cfg.ServerName {
+		return "", ErrLinkAuth
+	}
+
+	err = enc.Encode(linkMsg{
+		Type: "auth",
+		Mac:  s.linkMac(hello.Nonce, s.cfg.ServerName),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var auth linkMsg
+	err = dec.Decode(&auth)
+	if err != nil {
+		return "", err
+	}
+	expected := s.linkMac(ours, hello.Server)
+	if auth.Type != "auth" || !hmac.Equal([]byte(auth.Mac), []byte(expected)) {
+		return "", ErrLinkAuth
+	}
+
+	return hello.Server, nil
+}
+
+func (s *Server) linkMac(nonce string, server string) string {
+	h := hmac.New(sha256.New, []byte(s.cfg.LinkSecret))
+	h.Write([]byte(nonce + " " + server))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tells the rooms about the new link, then bursts every member we know about to it
+func (s *Server) netjoin(l *link) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ch := range s.rooms {
+		ch.broadcast(event{
+			kind: evNotice,
+			text: "Netjoin: linked with " + l.peer,
+		})
+	}
+
+	for _, m := range s.names {
+		if m.room == nil || m.via == l {
+			continue
+		}
+
+		origin, name := m.remote, m.name
+		if origin == "" {
+			origin, name = s.cfg.ServerName, s.linkName(m.name)
+		}
+		l.send(linkMsg{
+			Type:   "burst",
+			Origin: origin,
+			Kind:   "join",
+			Room:   m.room.name,
+			From:   name,
+		})
+	}
+}
+
+// drops everyone we heard of through the link, and lets the other links know they are gone too
+func (s *Server) netsplit(l *link) {
+	f := s.fed
+	f.mu.Lock()
+	if f.links[l.peer] == l {
+		delete(f.links, l.peer)
+	}
+	f.mu.Unlock()
+
+	log.Printf("netsplit from %v", l.peer)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ch := range s.rooms {
+		ch.broadcast(event{
+			kind: evNotice,
+			text: "Netsplit: lost link to " + l.peer,
+		})
+	}
+
+	gone := make([]string, 0)
+	for key, m := range s.names {
+		if m.via == l {
+			gone = append(gone, key)
+		}
+	}
+	slices.Sort(gone)
+
+	for _, key := range gone {
+		m := s.names[key]
+		room := ""
+		if m.room != nil {
+			room = m.room.name
+		}
+		s.leave(m)
+		delete(s.names, key)
+
+		s.relay(linkMsg{
+			Type: "event",
+			Kind: "leave",
+			Room: room,
+			From: m.name,
+		})
+	}
+}
+
+func (s *Server) applyRemote(l *link, msg linkMsg) {
+	switch msg.Kind {
+	case "join":
+		s.applyJoin(l, msg)
+
+	case "leave":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		key := strings.ToLower(msg.From)
+		m := s.names[key]
+		if m == nil || m.remote == "" {
+			return
+		}
+		s.leave(m)
+		delete(s.names, key)
+
+	case "rename":
+		m, _ := s.remoteMember(msg.From)
+		if m == nil {
+			return
+		}
+		s.Rename(m, msg.To)
+
+	case "message":
+		m, room := s.remoteMember(msg.From)
+		if m == nil || room == nil {
+			return
+		}
+		room.SendMessage(m, msg.Text)
+
+	case "private":
+		to, ok := strings.CutSuffix(msg.To, "@"+s.cfg.ServerName)
+		if !ok {
+			// someone else's, routePrivate passes it on
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		target := s.names[strings.ToLower(to)]
+		if target == nil || target.remote != "" {
+			return
+		}
+		target.Deliver(event{
+			kind: evPrivate,
+			from: msg.From,
+			to:   target.name,
+			text: msg.Text,
+		})
+	}
+}
+
+// false if we knew about the member already
+func (s *Server) applyJoin(l *link, msg linkMsg) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg.Kind != "join" || !strings.Contains(msg.From, "@") || msg.Room == "" {
+		return false
+	}
+	key := strings.ToLower(msg.From)
+	if s.names[key] != nil {
+		return false
+	}
+
+	m := makeRemoteMember(msg.From, msg.Origin, l)
+	ch, ok := s.rooms[msg.Room]
+	if !ok {
+		ch = s.makeRoom(msg.Room)
+	}
+	err := s.join(m, ch)
+	if err != nil {
+		return false
+	}
+	s.names[key] = m
+	return true
+}
+
+// the remote member and the room they're in.
+// the room has to be read here, another link can make them leave as soon as the lock is gone.
+func (s *Server) remoteMember(name string) (*Member, *Chatroom) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.names[strings.ToLower(name)]
+	if m == nil || m.remote == "" {
+		return nil, nil
+	}
+	return m, m.room
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestFederation(t *testing.T) {
+	eu := MakeServer(Config{ServerName: "eu", LinkSecret: "hunter2"})
+	us := MakeServer(Config{ServerName: "us", LinkSecret: "hunter2"})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go eu.ListenLinks(ln)
+
+	alice, aliceConn := makeTestMember("alice")
+	eu.Register(alice)
+	eu.Join(alice, defaultRoom)
+	aliceConn.expect(t, "* The room contains: \n")
+
+	bob, bobConn := makeTestMember("bob")
+	us.Register(bob)
+	us.Join(bob, defaultRoom)
+	bobConn.expect(t, "* The room contains: \n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go us.LinkTo(ctx, ln.Addr().String())
+
+	aliceConn.expect(t, "* Netjoin: linked with us\n* bob@us has entered the room\n")
+	bobConn.expect(t, "* Netjoin: linked with eu\n* alice@eu has entered the room\n")
+
+	bob.room.SendMessage(bob, "hi from the us")
+	aliceConn.expect(t, "[bob@us] hi from the us\n")
+
+	alice.room.SendMessage(alice, "hi from the eu")
+	bobConn.expect(t, "[alice@eu] hi from the eu\n")
+
+	eu.handleCommand(alice, "/who")
+	aliceConn.expect(t, "* The room contains: alice, bob@us\n")
+
+	eu.handleCommand(alice, "/msg bob@us psst")
+	bobConn.expect(t, "[alice@eu -> bob] psst\n")
+
+	alice.oper = true
+	eu.handleCommand(alice, "/kick bob@us")
+	aliceConn.expect(t, "* bob@us is on another server\n")
+
+	us.handleCommand(bob, "/nick carol")
+	bobConn.expect(t, "* bob is now known as carol\n")
+	aliceConn.expect(t, "* bob@us is now known as carol@us\n")
+
+	carol, carolConn := makeTestMember("carol")
+	eu.Register(carol)
+	eu.Join(carol, defaultRoom)
+	carolConn.expect(t, "* The room contains: alice, carol@us\n")
+	aliceConn.expect(t, "* carol has entered the room\n")
+	bobConn.expect(t, "* carol@eu has entered the room\n")
+
+	// netsplit
+	cancel()
+	aliceConn.expect(t, "* Netsplit: lost link to us\n* carol@us has left the room\n")
+	bobConn.expect(t, "* Netsplit: lost link to eu\n* alice@eu has left the room\n* carol@eu has left the room\n")
+
+	eu.handleCommand(alice, "/who")
+	aliceConn.expect(t, "* The room contains: alice, carol\n")
+}
+
+func TestFederationBadSecret(t *testing.T) {
+	eu := MakeServer(Config{ServerName: "eu", LinkSecret: "hunter2"})
+	mallory := MakeServer(Config{ServerName: "mallory", LinkSecret: "letmein"})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go eu.ListenLinks(ln)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mallory.runLink(c)
+	if !errors.Is(err, ErrLinkAuth) {
+		t.Fatalf("wrong link error. expected %v got %v", ErrLinkAuth, err)
+	}
+}
+
+func TestFederationDedupe(t *testing.T) {
+	type dedupeCases struct {
+		msg   linkMsg
+		first bool
+	}
+
+	cases := []dedupeCases{
+		{linkMsg{Origin: "eu", Epoch: 1, Seq: 1}, true},
+		{linkMsg{Origin: "eu", Epoch: 1, Seq: 2}, true},
+		// same event coming round another way
+		{linkMsg{Origin: "eu", Epoch: 1, Seq: 2}, false},
+		{linkMsg{Origin: "eu", Epoch: 1, Seq: 1}, false},
+		{linkMsg{Origin: "us", Epoch: 1, Seq: 1}, true},
+		// eu restarted
+		{linkMsg{Origin: "eu", Epoch: 2, Seq: 1}, true},
+	}
+
+	f := makeFederation()
+	for i, c := range cases {
+		first := f.firstTime(c.msg)
+		if first != c.first {
+			t.Fatalf("wrong dedupe for case %v. expected %v got %v", i, c.first, first)
+		}
+	}
+}
+
+// a link that nothing reads from, so the test can look at what got queued on it
+func makeTestLink(s *Server, peer string) *link {
+	c, _ := net.Pipe()
+	l := &link{
+		peer: peer,
+		c:    c,
+		out:  make(chan linkMsg, linkQueueSize),
+		done: make(chan struct{}),
+	}
+	s.fed.links[peer] = l
+	return l
+}
+
+func TestFederationConcurrentRelay(t *testing.T) {
+	s := MakeServer(Config{ServerName: "eu"})
+	l := makeTestLink(s, "us")
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range linkQueueSize / 8 {
+				s.relay(linkMsg{Type: "event", Kind: "message"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the other side drops anything that isn't newer than what it had, so the link has to be in order
+	var last uint64
+	for len(l.out) > 0 {
+		msg := <-l.out
+		if msg.Seq != last+1 {
+			t.Fatalf("wrong seq on the link. expected %v got %v", last+1, msg.Seq)
+		}
+		last = msg.Seq
+	}
+	if last != linkQueueSize/8*8 {
+		t.Fatalf("wrong number of messages. expected %v got %v", linkQueueSize/8*8, last)
+	}
+}
+
+func TestFederationPrivateRouting(t *testing.T) {
+	s := MakeServer(Config{ServerName: "eu"})
+	us := makeTestLink(s, "us")
+	asia := makeTestLink(s, "asia")
+
+	alice, _ := makeTestMember("alice")
+	s.Register(alice)
+	s.Join(alice, defaultRoom)
+	s.applyJoin(us, linkMsg{Kind: "join", From: "bob@us", Origin: "us", Room: defaultRoom})
+	// alice joining went everywhere
+	for _, l := range []*link{us, asia} {
+		for len(l.out) > 0 {
+			<-l.out
+		}
+	}
+
+	err := s.Whisper(alice, "bob@us", "psst")
+	if err != nil {
+		t.Fatalf("whisper: %v", err)
+	}
+	if len(us.out) != 1 || len(asia.out) != 0 {
+		t.Fatalf("wrong links. expected 1 message to us and none to asia got %v and %v", len(us.out), len(asia.out))
+	}
+
+	// passing on someone else's goes the same way
+	<-us.out
+	s.routePrivate(linkMsg{Type: "event", Kind: "private", From: "carol@asia", To: "bob@us", Origin: "asia"}, asia)
+	if len(us.out) != 1 || len(asia.out) != 0 {
+		t.Fatalf("wrong links. expected 1 message to us and none to asia got %v and %v", len(us.out), len(asia.out))
+	}
+}
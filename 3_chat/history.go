@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHistorySize   = 100
+	defaultHistoryReplay = 10
+)
+
+type entry struct {
+	at time.Time
+	ev event
+}
+
+func (e entry) String() string {
+	return fmt.Sprintf("[%v] %v", e.at.Format(time.TimeOnly), e.ev)
+}
+
+// the entry as it gets replayed to members
+func (e entry) event() event {
+	return event{
+		kind: evHistory,
+		room: e.ev.room,
+		text: e.String(),
+	}
+}
+
+// Ring buffer of the last few lines said in a room.
+// Not synchronized, the room takes care of that.
+type history struct {
+	entries []entry
+	start   int // oldest entry
+	len     int
+	now     func() time.Time
+}
+
+func makeHistory(size int) *history {
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	return &history{
+		entries: make([]entry, size),
+		now:     time.Now,
+	}
+}
+
+func (h *history) add(ev event) {
+	e := entry{
+		at: h.now(),
+		ev: ev,
+	}
+
+	if h.len < len(h.entries) {
+		h.entries[(h.start+h.len)%len(h.entries)] = e
+		h.len++
+		return
+	}
+
+	// full, overwrite the oldest
+	h.entries[h.start] = e
+	h.start = (h.start + 1) % len(h.entries)
+}
+
+// last n entries, oldest first
+func (h *history) last(n int) []entry {
+	n = min(n, h.len)
+	ret := make([]entry, n)
+	for i := range ret {
+		ret[i] = h.entries[(h.start+h.len-n+i)%len(h.entries)]
+	}
+	return ret
+}
+
+// Log file of everything said in every room.
+// Once the file grows past maxSize it gets renamed to path.1 (path.1 to path.2 and so on)
+// and a fresh one is started. Only keep files are kept around.
+//
+// Rooms only queue lines, one goroutine does the writing, so a slow disk never holds up a room.
+// If it falls that far behind lines get dropped.
+type transcript struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	f    *os.File
+	size int64
+	mu   sync.Mutex
+
+	queue   chan transcriptLine
+	done    chan struct{} // closed once the queue is written out
+	closed  bool
+	queueMu sync.RWMutex // so nothing gets queued after Close
+}
+
+type transcriptLine struct {
+	room string
+	e    entry
+}
+
+// lines waiting for the disk before new ones get dropped
+const transcriptQueueSize = 1024
+
+func openTranscript(path string, maxSize int64, keep int) (*transcript, error) {
+	t := &transcript{
+		path:    path,
+		maxSize: maxSize,
+		keep:    keep,
+		queue:   make(chan transcriptLine, transcriptQueueSize),
+		done:    make(chan struct{}),
+	}
+	err := t.open()
+	if err != nil {
+		return nil, err
+	}
+	go t.writeLoop()
+	return t, nil
+}
+
+// queues the line for the writer, never blocks
+func (t *transcript) add(room string, e entry) {
+	t.queueMu.RLock()
+	defer t.queueMu.RUnlock()
+
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- transcriptLine{room, e}:
+	default:
+		log.Println("transcript can't keep up, dropping a line")
+	}
+}
+
+func (t *transcript) writeLoop() {
+	defer close(t.done)
+	for l := range t.queue {
+		err := t.write(l.room, l.e)
+		if err != nil {
+			log.Println("failed to write transcript:", err)
+		}
+	}
+}
+
+func (t *transcript) open() error {
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f = f
+	t.size = info.Size()
+	return nil
+}
+
+func (t *transcript) write(room string, e entry) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.f == nil {
+		return os.ErrClosed
+	}
+
+	if t.maxSize > 0 && t.size >= t.maxSize {
+		err := t.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := fmt.Fprintf(t.f, "%v %v %v", e.at.Format(time.RFC3339), room, e.ev)
+	t.size += int64(n)
+	return err
+}
+
+func (t *transcript) rotate() error {
+	t.f.Close()
+	t.f = nil
+
+	for i := t.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%v", t.path, i), fmt.Sprintf("%v.%v", t.path, i+1))
+	}
+	if t.keep > 0 {
+		os.Rename(t.path, t.path+".1")
+	} else {
+		os.Remove(t.path)
+	}
+
+	return t.open()
+}
+
+// writes out whatever is still queued, then closes the file
+func (t *transcript) Close() error {
+	t.queueMu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.queueMu.Unlock()
+	<-t.done
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.f == nil {
+		return nil
+	}
+	err := t.f.Close()
+	t.f = nil
+	return err
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// what we call ourselves in server prefixes
+const ircServerName = "budgetchat"
+
+// numeric replies, RFC 2812 section 5
+const (
+	rplWelcome         = "001"
+	rplNamReply        = "353"
+	rplEndOfNames      = "366"
+	errNoSuchNick      = "401"
+	errNoSuchChannel   = "403"
+	errCannotSendToCh  = "404"
+	errUnknownCommand  = "421"
+	errNoMotd          = "422"
+	errErroneusName    = "432"
+	errNicknameInUse   = "433"
+	errNotOnChannel    = "442"
+	errNotRegistered   = "451"
+	errNeedMoreParams  = "461"
+	errAlreadyRegisted = "462"
+)
+
+// Formats chat events as IRC messages.
+// Rooms show up as channels, #general being the default room.
+type ircFormatter struct {
+	// own nick, needed for numeric replies.
+	// events get formatted by whoever sends them so this can't just be Member.name.
+	nick atomic.Value
+}
+
+func (f *ircFormatter) getNick() string {
+	nick, _ := f.nick.Load().(string)
+	if nick == "" {
+		return "*"
+	}
+	return nick
+}
+
+func (f *ircFormatter) format(e event) string {
+	nick := f.getNick()
+	channel := "#" + e.room
+
+	switch e.kind {
+	case evMessage:
+		return ircLine(ircPrefix(e.from), "PRIVMSG", channel, e.text)
+	case evJoin:
+		return ircLine(ircPrefix(e.from), "JOIN", channel)
+	case evLeave:
+		return ircLine(ircPrefix(e.from), "PART", channel)
+	case evRename:
+		return ircLine(ircPrefix(e.from), "NICK", ircNick(e.to))
+	case evEntered:
+		// names are everyone else, IRC wants us in there too
+		return ircLine(ircPrefix(nick), "JOIN", channel) +
+			f.names(channel, append(e.names, nick))
+	case evNames:
+		return f.names(channel, e.names)
+	case evPrivate:
+		return ircLine(ircPrefix(e.from), "PRIVMSG", e.to, e.text)
+	case evHistory:
+		return ircLine(ircServerName, "NOTICE", channel, strings.TrimSuffix(e.text, "\n"))
+	default:
+		return ircLine(ircServerName, "NOTICE", nick, e.text)
+	}
+}
+
+func (f *ircFormatter) names(channel string, names []string) string {
+	nick := f.getNick()
+	nicks := make([]string, 0, len(names))
+	for _, name := range names {
+		nicks = append(nicks, ircNick(name))
+	}
+	return ircLine(ircServerName, rplNamReply, nick, "=", channel, strings.Join(nicks, " ")) +
+		ircLine(ircServerName, rplEndOfNames, nick, channel, "End of /NAMES list")
+}
+
+// members on linked servers are called alice@eu, but an @ can't go in a nick.
+// they get alice|eu instead, a | can't be in a real name so it maps back fine.
+func ircNick(name string) string {
+	return strings.ReplaceAll(name, "@", "|")
+}
+
+func fromIRCNick(nick string) string {
+	return strings.ReplaceAll(nick, "|", "@")
+}
+
+// alice|eu!alice@eu.budgetchat for remote members
+func ircPrefix(name string) string {
+	user, server, remote := strings.Cut(name, "@")
+	host := ircServerName
+	if remote {
+		host = server + "." + ircServerName
+	}
+	return fmt.Sprintf("%v!%v@%v", ircNick(name), user, host)
+}
+
+// the last param always goes out as a trailing one, so it can have spaces
+func ircLine(prefix string, cmd string, params ...string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(cmd)
+	for i, p := range params {
+		if i == len(params)-1 {
+			b.WriteString(" :" + p)
+		} else {
+			b.WriteString(" " + p)
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// splits an IRC line into its command and params.
+// the prefix is thrown away, clients don't get to pick theirs.
+func parseIRC(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	params := strings.Fields(line)
+	if len(params) == 0 {
+		return "", nil
+	}
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// Speaks just enough of RFC 1459/2812 for regular IRC clients to chat with everyone else.
+// Members can only be in one channel at a time, joining another one parts the current one.
+func (s *Server) handleIRC(c net.Conn) {
+	defer c.Close()
+
+	f := &ircFormatter{}
+	m := MakeMember(c, s.cfg.QueueSize, s.cfg.SlowPolicy)
+	m.fmt = f
+	defer m.Close()
+
+	reply := func(numeric string, params ...string) {
+		m.Send(ircLine(ircServerName, numeric, append([]string{f.getNick()}, params...)...))
+	}
+
+	if s.bans.bannedIP(m.ip()) {
+		m.Send(ircLine("", "ERROR", "You are banned"))
+		return
+	}
+
+	if !s.ircRegister(m, f, reply) {
+		return
+	}
+	defer s.Unregister(m)
+
+	reply(rplWelcome, "Welcome to budgetchat, "+m.name)
+	reply(errNoMotd, "MOTD File is missing")
+
+	for {
+		line, ok := m.Recv()
+		if !ok {
+			return
+		}
+		cmd, params := parseIRC(line)
+
+		switch cmd {
+		case "":
+			continue
+
+		case "PING":
+			m.Send(ircLine(ircServerName, "PONG", append([]string{ircServerName}, params...)...))
+
+		case "PONG", "CAP":
+			continue
+
+		case "QUIT":
+			return
+
+		case "NICK":
+			if len(params) == 0 || !validateName(params[0]) {
+				reply(errErroneusName, strings.Join(params, " "), "Erroneous nickname")
+				continue
+			}
+			old := m.name
+			err := s.Rename(m, params[0])
+			if err != nil {
+				reply(errNicknameInUse, params[0], "Nickname is already in use")
+				continue
+			}
+			f.nick.Store(m.name)
+			if m.room == nil {
+				// no room to broadcast it to us
+				m.Send(ircLine(ircPrefix(old), "NICK", m.name))
+			}
+
+		case "USER":
+			reply(errAlreadyRegisted, "You may not reregister")
+
+		case "JOIN":
+			if len(params) == 0 {
+				reply(errNeedMoreParams, "JOIN", "Not enough parameters")
+				continue
+			}
+			if params[0] == "0" {
+				s.ircPart(m)
+				continue
+			}
+			// only one channel at a time, so just take the first one
+			channel, _, _ := strings.Cut(params[0], ",")
+			name, ok := strings.CutPrefix(channel, "#")
+			if !ok || !validateName(name) {
+				reply(errNoSuchChannel, channel, "No such channel")
+				continue
+			}
+			if m.room != nil && m.room.name == name {
+				continue
+			}
+			s.ircPart(m)
+			err := s.Join(m, name)
+			if err != nil {
+				reply(errNicknameInUse, m.name, "Nickname is already in use")
+			}
+
+		case "PART":
+			if len(params) == 0 {
+				reply(errNeedMoreParams, "PART", "Not enough parameters")
+				continue
+			}
+			if m.room == nil || params[0] != "#"+m.room.name {
+				reply(errNotOnChannel, params[0], "You're not on that channel")
+				continue
+			}
+			s.ircPart(m)
+
+		case "PRIVMSG", "NOTICE":
+			if len(params) < 2 {
+				reply(errNeedMoreParams, cmd, "Not enough parameters")
+				continue
+			}
+			target, text := params[0], params[1]
+
+			if !s.canSpeak(m) {
+				continue
+			}
+
+			if strings.HasPrefix(target, "#") {
+				if m.room == nil || target != "#"+m.room.name {
+					reply(errCannotSendToCh, target, "Cannot send to channel")
+					continue
+				}
+				m.room.SendMessage(m, text)
+				continue
+			}
+
+			err := s.Whisper(m, fromIRCNick(target), text)
+			if errors.Is(err, ErrNoSuchMember) {
+				reply(errNoSuchNick, target, "No such nick/channel")
+			}
+
+		case "NAMES":
+			if m.room == nil {
+				reply(rplEndOfNames, strings.Join(params, " "), "End of /NAMES list")
+				continue
+			}
+			m.Deliver(event{
+				kind:  evNames,
+				room:  m.room.name,
+				names: m.room.Who(),
+			})
+
+		default:
+			reply(errUnknownCommand, cmd, "Unknown command")
+		}
+	}
+}
+
+// waits for both NICK and USER. false if they left before that.
+func (s *Server) ircRegister(m *Member, f *ircFormatter, reply func(string, ...string)) bool {
+	nick := ""
+	user := false
+
+	for {
+		line, ok := m.Recv()
+		if !ok {
+			return false
+		}
+		cmd, params := parseIRC(line)
+
+		switch cmd {
+		case "NICK":
+			if len(params) == 0 || !validateName(params[0]) {
+				reply(errErroneusName, strings.Join(params, " "), "Erroneous nickname")
+				continue
+			}
+			nick = params[0]
+		case "USER":
+			if len(params) < 4 {
+				reply(errNeedMoreParams, "USER", "Not enough parameters")
+				continue
+			}
+			user = true
+		case "PING":
+			m.Send(ircLine(ircServerName, "PONG", append([]string{ircServerName}, params...)...))
+		case "CAP":
+			// no capabilities, but clients wait for an answer
+			if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+				m.Send(ircLine(ircServerName, "CAP", "*", "LS", ""))
+			}
+		case "QUIT":
+			return false
+		default:
+			reply(errNotRegistered, "You have not registered")
+		}
+
+		if nick == "" || !user {
+			continue
+		}
+
+		m.name = nick
+		err := s.Register(m)
+		if errors.Is(err, ErrBanned) {
+			m.Send(ircLine("", "ERROR", "You are banned"))
+			return false
+		}
+		if err != nil {
+			reply(errNicknameInUse, nick, "Nickname is already in use")
+			nick = ""
+			continue
+		}
+
+		f.nick.Store(nick)
+		log.Println(m.conn.RemoteAddr(), "registered over irc as", nick)
+		return true
+	}
+}
+
+// leaves the current channel, letting the client know
+func (s *Server) ircPart(m *Member) {
+	if m.room == nil {
+		return
+	}
+	channel := "#" + m.room.name
+	s.Leave(m)
+	m.Send(ircLine(ircPrefix(m.name), "PART", channel))
+}
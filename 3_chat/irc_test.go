@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIRC(t *testing.T) {
+	type ircCases struct {
+		in     string
+		cmd    string
+		params []string
+	}
+
+	cases := []ircCases{
+		{"NICK bob", "NICK", []string{"bob"}},
+		{"USER bob 0 * :Bob the Builder", "USER", []string{"bob", "0", "*", "Bob the Builder"}},
+		{":bob!bob@host privmsg #general :hi there :)", "PRIVMSG", []string{"#general", "hi there :)"}},
+		{"PING :token", "PING", []string{"token"}},
+	}
+
+	for _, c := range cases {
+		cmd, params := parseIRC(c.in)
+		if cmd != c.cmd || !reflect.DeepEqual(params, c.params) {
+			t.Fatalf("wrong parse for %q. expected %v %q got %v %q", c.in, c.cmd, c.params, cmd, params)
+		}
+	}
+}
+
+func TestIRC(t *testing.T) {
+	s := MakeServer(Config{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.handleIRC(c)
+	}()
+
+	alice, aliceConn := makeTestMember("alice")
+	s.Register(alice)
+	s.Join(alice, defaultRoom)
+	aliceConn.expect(t, "* The room contains: \n")
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+
+	send := func(line string) {
+		t.Helper()
+		_, err := c.Write([]byte(line + "\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want+"\r\n" {
+			t.Fatalf("wrong irc line. expected %q got %q", want, got)
+		}
+	}
+
+	send("CAP LS 302")
+	expect(":budgetchat CAP * LS :")
+	send("NICK ALICE")
+	send("USER bob 0 * :Bob")
+	expect(":budgetchat 433 * ALICE :Nickname is already in use")
+	send("NICK bob")
+	expect(":budgetchat 001 bob :Welcome to budgetchat, bob")
+	expect(":budgetchat 422 bob :MOTD File is missing")
+
+	send("JOIN #general")
+	expect(":bob!bob@budgetchat JOIN :#general")
+	expect(":budgetchat 353 bob = #general :alice bob")
+	expect(":budgetchat 366 bob #general :End of /NAMES list")
+	aliceConn.expect(t, "* bob has entered the room\n")
+
+	alice.room.SendMessage(alice, "hi")
+	expect(":alice!alice@budgetchat PRIVMSG #general :hi")
+
+	send("PRIVMSG #general :hello from irc")
+	aliceConn.expect(t, "[bob] hello from irc\n")
+
+	send("PRIVMSG alice :psst")
+	aliceConn.expect(t, "[bob -> alice] psst\n")
+
+	send("PING :123")
+	expect(":budgetchat PONG budgetchat :123")
+
+	send("NICK carol")
+	expect(":bob!bob@budgetchat NICK :carol")
+	aliceConn.expect(t, "* bob is now known as carol\n")
+
+	send("PART #general")
+	expect(":carol!carol@budgetchat PART :#general")
+	aliceConn.expect(t, "* carol has left the room\n")
+
+	send("QUIT")
+	_, err = r.ReadString('\n')
+	if err == nil {
+		t.Fatalf("expected connection to be closed after QUIT")
+	}
+}
+
+func TestIRCPrefix(t *testing.T) {
+	cases := map[string]string{
+		"alice":    "alice!alice@budgetchat",
+		"alice@eu": "alice|eu!alice@eu.budgetchat",
+	}
+	for name, expected := range cases {
+		got := ircPrefix(name)
+		if got != expected || strings.Count(got, "@") != 1 {
+			t.Fatalf("wrong prefix for %v. expected %v got %v", name, expected, got)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// What to do with a member that can't keep up with the room.
+type SlowPolicy int
+
+const (
+	// throw away the oldest queued line to make room for the new one
+	DropOldest SlowPolicy = iota
+	// tell them they are too slow and hang up
+	Disconnect
+)
+
+const (
+	defaultQueueSize = 64
+	// how long we wait on the last writes of a member that is leaving
+	flushTimeout = time.Second
+)
+
+// Sends never block.
+// Lines are queued and a writer goroutine drains them onto the connection,
+// so a stalled client only ever holds up itself.
+type Member struct {
+	conn net.Conn
+	sc   *bufio.Scanner
+	fmt  formatter
+	name string
+	// only changed by the goroutine handling the connection, under Server.mu.
+	// that goroutine can read it freely, anyone else needs Server.mu.
+	room *Chatroom
+
+	// only touched by the goroutine handling the connection
+	oper        bool
+	recent      []time.Time // when the last few lines were said, for flood control
+	floodWarned bool
+
+	mutedUntil time.Time // guarded by mu
+
+	// only set for members on another server.
+	// remote is the server they are on, via the link we heard of them through.
+	remote string
+	via    *link
+
+	out      chan string
+	policy   SlowPolicy
+	mu       sync.Mutex // guards out when dropping lines, and closed
+	closed   bool
+	notice   string        // last words for disconnected slow members
+	quit     chan struct{} // closed once no more lines should be queued
+	finished chan struct{} // closed once the writer is done
+}
+
+func MakeMember(conn net.Conn, queueSize int, policy SlowPolicy) *Member {
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	m := &Member{
+		conn:     conn,
+		sc:       bufio.NewScanner(conn),
+		fmt:      nativeFormatter{},
+		out:      make(chan string, queueSize),
+		policy:   policy,
+		quit:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go m.writeLoop()
+	return m
+}
+
+// stand-in for a member on another server.
+// anything sent to it goes nowhere, the other server delivers to the real one.
+func makeRemoteMember(name string, origin string, via *link) *Member {
+	return &Member{
+		fmt:    nativeFormatter{},
+		name:   name,
+		remote: origin,
+		via:    via,
+		closed: true,
+	}
+}
+
+func (m *Member) Send(s string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	select {
+	case m.out <- s:
+		return
+	default:
+	}
+
+	switch m.policy {
+	case DropOldest:
+		// the writer might have made room in the meantime
+		select {
+		case <-m.out:
+		default:
+		}
+		// only senders fill the queue and we are holding the lock, so this never blocks
+		m.out <- s
+	case Disconnect:
+		m.disconnect(m.fmt.format(event{
+			kind: evNotice,
+			text: "You are too slow. Disconnecting now...",
+		}))
+	}
+}
+
+// formats the event for whatever client the member is using, then sends it
+func (m *Member) Deliver(e event) {
+	m.Send(m.fmt.format(e))
+}
+
+func (m *Member) Notice(text string) {
+	m.Deliver(event{
+		kind: evNotice,
+		text: text,
+	})
+}
+
+// drops whatever is queued, tells them why and hangs up.
+func (m *Member) Kick(reason string) {
+	notice := m.fmt.format(event{
+		kind: evNotice,
+		text: reason,
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+	m.disconnect(notice)
+}
+
+func (m *Member) disconnect(notice string) {
+	m.notice = notice
+	m.stop()
+}
+
+// no more lines get queued, and the writer gets flushTimeout to finish up.
+// the deadline also breaks a write that is already stuck on a stalled client, which never looks at quit.
+// needs mu.
+func (m *Member) stop() {
+	m.closed = true
+	close(m.quit)
+	m.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+}
+
+func (m *Member) MuteFor(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mutedUntil = time.Now().Add(d)
+}
+
+// how much longer the member is muted for
+func (m *Member) Muted() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return time.Until(m.mutedUntil)
+}
+
+func (m *Member) ip() string {
+	if m.conn == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(m.conn.RemoteAddr().String())
+	if err != nil {
+		return m.conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// next line from the member. false once they are gone.
+func (m *Member) Recv() (string, bool) {
+	if !m.sc.Scan() {
+		return "", false
+	}
+	return m.sc.Text(), true
+}
+
+// stops the writer after it gets through whatever is still queued.
+func (m *Member) Close() {
+	m.mu.Lock()
+	if !m.closed {
+		m.stop()
+	}
+	m.mu.Unlock()
+
+	<-m.finished
+}
+
+func (m *Member) writeLoop() {
+	defer close(m.finished)
+
+	for {
+		select {
+		case s := <-m.out:
+			_, err := m.conn.Write([]byte(s))
+			if err != nil {
+				m.conn.Close()
+				return
+			}
+
+		case <-m.quit:
+			if m.notice != "" {
+				m.conn.Write([]byte(m.notice))
+			} else {
+				m.flush()
+			}
+			// kicks the reading side out of its loop too
+			m.conn.Close()
+			return
+		}
+	}
+}
+
+func (m *Member) flush() {
+	for {
+		select {
+		case s := <-m.out:
+			_, err := m.conn.Write([]byte(s))
+			if err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
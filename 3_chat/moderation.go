@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Banned names and IPs.
+// Every change is written straight to the ban file, if there is one.
+type banList struct {
+	path  string
+	names map[string]bool // lowercased
+	ips   map[string]bool
+	mu    sync.Mutex
+}
+
+// loads the bans from path, which may not exist yet.
+// an empty path keeps the bans in memory only.
+func loadBans(path string) (*banList, error) {
+	b := &banList{
+		path:  path,
+		names: make(map[string]bool),
+		ips:   make(map[string]bool),
+	}
+	if path == "" {
+		return b, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return b, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	// one ban per line. either "ip <ip>" or "name <name>"
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		kind, target, _ := strings.Cut(sc.Text(), " ")
+		switch kind {
+		case "ip":
+			b.ips[target] = true
+		case "name":
+			b.names[strings.ToLower(target)] = true
+		}
+	}
+	return b, sc.Err()
+}
+
+// target is either a name or an IP
+func (b *banList) add(target string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if net.ParseIP(target) != nil {
+		b.ips[target] = true
+	} else {
+		b.names[strings.ToLower(target)] = true
+	}
+	return b.save()
+}
+
+// returns false if the target wasn't banned to begin with
+func (b *banList) remove(target string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := target
+	bans := b.ips
+	if net.ParseIP(target) == nil {
+		key = strings.ToLower(target)
+		bans = b.names
+	}
+	if !bans[key] {
+		return false, nil
+	}
+	delete(bans, key)
+	return true, b.save()
+}
+
+func (b *banList) bannedName(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.names[strings.ToLower(name)]
+}
+
+func (b *banList) bannedIP(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ips[ip]
+}
+
+func (b *banList) save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	lines := make([]string, 0, len(b.ips)+len(b.names))
+	for ip := range b.ips {
+		lines = append(lines, "ip "+ip)
+	}
+	for name := range b.names {
+		lines = append(lines, "name "+name)
+	}
+	slices.Sort(lines)
+
+	tmp := b.path + ".tmp"
+	err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+func (s *Server) Oper(m *Member, password string) bool {
+	if s.cfg.OperPassword == "" || password != s.cfg.OperPassword {
+		s.audit.Printf("%v (%v) failed to become an operator", m.name, m.ip())
+		return false
+	}
+
+	m.oper = true
+	s.audit.Printf("%v (%v) is now an operator", m.name, m.ip())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.announce(m, m.name+" is now an operator")
+	return true
+}
+
+func (s *Server) Kick(op *Member, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := s.names[strings.ToLower(name)]
+	if target == nil {
+		return ErrNoSuchMember
+	}
+	if target.remote != "" {
+		return ErrRemoteMember
+	}
+
+	s.kick(target, fmt.Sprintf("%v was kicked by %v", target.name, op.name))
+	s.audit.Printf("%v kicked %v (%v)", op.name, target.name, target.ip())
+	return nil
+}
+
+// lets the target's room know why they are going away, then disconnects them.
+// their connection goroutine takes care of the rest.
+func (s *Server) kick(target *Member, reason string) {
+	if target.room != nil {
+		target.room.broadcast(event{
+			kind: evNotice,
+			text: reason,
+		}, target)
+	}
+	target.Kick(reason)
+}
+
+func (s *Server) Mute(op *Member, name string, d time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := s.names[strings.ToLower(name)]
+	if target == nil {
+		return ErrNoSuchMember
+	}
+	if target.remote != "" {
+		return ErrRemoteMember
+	}
+
+	s.mute(target, d, fmt.Sprintf("%v was muted for %v by %v", target.name, d, op.name))
+	s.audit.Printf("%v muted %v (%v) for %v", op.name, target.name, target.ip(), d)
+	return nil
+}
+
+func (s *Server) mute(target *Member, d time.Duration, reason string) {
+	target.MuteFor(d)
+	s.announce(target, reason)
+}
+
+// tells m's room, or just m if they aren't in one. needs s.mu.
+func (s *Server) announce(m *Member, text string) {
+	if m.room != nil {
+		m.room.broadcast(event{
+			kind: evNotice,
+			text: text,
+		})
+	} else {
+		m.Notice(text)
+	}
+}
+
+// bans a name or an IP, and kicks whoever it matches
+func (s *Server) Ban(op *Member, target string) error {
+	err := s.bans.add(target)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.audit.Printf("%v banned %v", op.name, target)
+	for _, m := range s.names {
+		if m.remote != "" {
+			// their own server's operators have to deal with them
+			continue
+		}
+		if !strings.EqualFold(m.name, target) && m.ip() != target {
+			continue
+		}
+		s.kick(m, fmt.Sprintf("%v was banned by %v", m.name, op.name))
+		s.audit.Printf("%v (%v) kicked due to ban on %v", m.name, m.ip(), target)
+	}
+	return nil
+}
+
+func (s *Server) Unban(op *Member, target string) (bool, error) {
+	ok, err := s.bans.remove(target)
+	if ok {
+		s.audit.Printf("%v unbanned %v", op.name, target)
+
+		// they can't be here, so it goes to whoever saw the operator do it
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.announce(op, fmt.Sprintf("%v was unbanned by %v", target, op.name))
+	}
+	return ok, err
+}
+
+// checks whether what the member is about to say should go through.
+// lets them know if it doesn't.
+func (s *Server) canSpeak(m *Member) bool {
+	if left := m.Muted(); left > 0 {
+		m.Notice(fmt.Sprintf("You are muted for another %v", left.Round(time.Second)))
+		return false
+	}
+
+	if s.cfg.FloodLimit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	recent := m.recent[:0]
+	for _, t := range m.recent {
+		if now.Sub(t) < s.cfg.FloodWindow {
+			recent = append(recent, t)
+		}
+	}
+	m.recent = append(recent, now)
+
+	if len(m.recent) <= s.cfg.FloodLimit {
+		return true
+	}
+
+	if !m.floodWarned {
+		m.floodWarned = true
+		m.Notice("You are sending messages too fast. Slow down or you will be muted.")
+		return false
+	}
+
+	m.floodWarned = false
+	m.recent = m.recent[:0]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mute(m, s.cfg.FloodMute, fmt.Sprintf("%v was muted for %v for flooding", m.name, s.cfg.FloodMute))
+	s.audit.Printf("%v (%v) muted for %v for flooding", m.name, m.ip(), s.cfg.FloodMute)
+	return false
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchMember = fmt.Errorf("no such member")
+	ErrBanned       = fmt.Errorf("banned")
+)
+
+// everyone lands here after picking a name.
+// clients that never send a command never leave it.
+const defaultRoom = "general"
+
+type Config struct {
+	// lines queued per member. 0 means defaultQueueSize.
+	QueueSize  int
+	SlowPolicy SlowPolicy
+
+	// lines kept per room. 0 means defaultHistorySize.
+	HistorySize int
+	// history lines sent to newcomers
+	HistoryReplay int
+	// log everything said here too. can be nil.
+	Transcript *transcript
+
+	// /oper is disabled if empty
+	OperPassword string
+	// nil means nobody is banned, and bans are forgotten on restart
+	Bans *banList
+	// where moderation actions are logged. nil means stderr.
+	Audit io.Writer
+
+	// more than FloodLimit lines in FloodWindow gets a warning, then a FloodMute long mute.
+	// 0 disables flood control.
+	FloodLimit  int
+	FloodWindow time.Duration
+	FloodMute   time.Duration
+
+	// how other servers know us. needed for linking, see federation.go.
+	ServerName string
+	// shared by every linked server
+	LinkSecret string
+
+	// pages allowed to open a websocket besides our own host, like "https://chat.example.com"
+	WSOrigins []string
+}
+
+// Keeps track of the named rooms.
+// Rooms are made on the first join and dropped once the last member leaves.
+// The default room is never dropped.
+//
+// Also makes sure names are unique across every room, ignoring case.
+//
+// Lock order is Server.mu then Chatroom.mu.
+type Server struct {
+	rooms map[string]*Chatroom
+	names map[string]*Member // lowercased name -> member
+	cfg   Config
+	mu    sync.Mutex
+
+	bans  *banList
+	audit *log.Logger
+	fed   *federation
+}
+
+func MakeServer(cfg Config) *Server {
+	bans := cfg.Bans
+	if bans == nil {
+		bans, _ = loadBans("")
+	}
+	audit := cfg.Audit
+	if audit == nil {
+		audit = os.Stderr
+	}
+
+	s := &Server{
+		cfg:   cfg,
+		bans:  bans,
+		audit: log.New(audit, "audit: ", log.LstdFlags),
+		rooms: make(map[string]*Chatroom),
+		names: make(map[string]*Member),
+		fed:   makeFederation(),
+	}
+	s.rooms[defaultRoom] = s.makeRoom(defaultRoom)
+	return s
+}
+
+func (s *Server) makeRoom(name string) *Chatroom {
+	ch := MakeChatroom(name, s.cfg.HistorySize, s.cfg.HistoryReplay, s.cfg.Transcript)
+	ch.relay = s.relayLocal
+	return ch
+}
+
+// claims the member's name.
+// needs to be done before joining any room.
+func (s *Server) Register(m *Member) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bans.bannedName(m.name) {
+		return ErrBanned
+	}
+
+	key := strings.ToLower(m.name)
+	if s.names[key] != nil {
+		return ErrNameTaken
+	}
+	s.names[key] = m
+	return nil
+}
+
+// leaves the current room and frees up the name
+func (s *Server) Unregister(m *Member) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.leave(m)
+	delete(s.names, strings.ToLower(m.name))
+}
+
+// takes the member out of their room, without putting them anywhere else
+func (s *Server) Leave(m *Member) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.leave(m)
+}
+
+// moves the member to the room, leaving the current one if any.
+func (s *Server) Join(m *Member, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, ok := s.rooms[name]
+	if !ok {
+		ch = s.makeRoom(name)
+	}
+
+	prev := m.room
+	s.leave(m)
+
+	err := s.join(m, ch)
+	if err != nil && prev != nil {
+		// put them back where they were
+		s.join(m, prev)
+	}
+	return err
+}
+
+func (s *Server) join(m *Member, ch *Chatroom) error {
+	err := ch.AddUser(m)
+	if err != nil {
+		return err
+	}
+	s.rooms[ch.name] = ch
+	m.room = ch
+	return nil
+}
+
+// renames the member everywhere, or not at all.
+func (s *Server) Rename(m *Member, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bans.bannedName(name) {
+		return ErrBanned
+	}
+
+	key := strings.ToLower(name)
+	if other := s.names[key]; other != nil && other != m {
+		return ErrNameTaken
+	}
+
+	if m.room != nil {
+		err := m.room.Rename(m, name)
+		if err != nil {
+			return err
+		}
+	} else {
+		m.name = name
+	}
+
+	for k, v := range s.names {
+		if v == m {
+			delete(s.names, k)
+		}
+	}
+	s.names[key] = m
+	return nil
+}
+
+// private message to a member in any room
+func (s *Server) Whisper(from *Member, to string, msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := s.names[strings.ToLower(to)]
+	if target == nil {
+		return ErrNoSuchMember
+	}
+
+	if target.remote != "" {
+		// only towards the server they're on, nobody else needs to see it
+		s.relayVia(linkMsg{
+			Type: "event",
+			Kind: "private",
+			From: s.linkName(from.name),
+			To:   target.name,
+			Text: msg,
+		}, target.via)
+		return nil
+	}
+
+	target.Deliver(event{
+		kind: evPrivate,
+		from: from.name,
+		to:   target.name,
+		text: msg,
+	})
+	return nil
+}
+
+func (s *Server) leave(m *Member) {
+	if m.room == nil {
+		return
+	}
+
+	ch := m.room
+	ch.RemoveUser(m)
+	m.room = nil
+
+	if ch.name != defaultRoom && ch.Len() == 0 {
+		delete(s.rooms, ch.name)
+	}
+}
+
+// all rooms with their member count, sorted by name
+func (s *Server) roomList() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.rooms))
+	for name := range s.rooms {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	rooms := make([]string, 0, len(names))
+	for _, name := range names {
+		rooms = append(rooms, fmt.Sprintf("%v (%v)", name, s.rooms[name].Len()))
+	}
+
+	return "Rooms: " + strings.Join(rooms, ", ")
+}
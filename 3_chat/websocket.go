@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// RFC 6455, section 1.3
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// anything bigger is not a chat line.
+// the newline it gets on the way to the member still has to fit in the scanner's buffer.
+const wsMaxMessage = bufio.MaxScanTokenSize - 1
+
+var (
+	errWsProtocol = fmt.Errorf("websocket protocol error")
+	errWsTooBig   = fmt.Errorf("websocket message too big")
+	errWsUTF8     = fmt.Errorf("websocket text message is not utf-8")
+)
+
+// Upgrades the request to a websocket and hands it over to the chat like any tcp client.
+// Each text frame is a line, both ways. Newlines inside one become spaces, it's still one line.
+//
+// Browsers send cookies along with websockets from any page, so only pages from our own host
+// or one of cfg.WSOrigins get to open one. Clients that aren't browsers don't send an Origin at all.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	upgrade := strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerContains(r.Header, "Connection", "upgrade")
+	if r.Method != http.MethodGet || !upgrade || key == "" {
+		http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if !s.wsOriginAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't upgrade this connection", http.StatusInternalServerError)
+		return
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		log.Println("websocket hijack failed:", err)
+		return
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"
+	_, err = c.Write([]byte(resp))
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	log.Println(c.RemoteAddr(), "connected over websocket")
+	s.handleConnection(&wsConn{
+		Conn: c,
+		r:    brw.Reader,
+	})
+}
+
+func (s *Server) wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(s.cfg.WSOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Makes a websocket look like a line based net.Conn.
+//
+// Reads give out one message at a time with a newline tacked on.
+// Writes turn every line into its own text frame.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	pending []byte // what is left of the current message
+
+	wmu       sync.Mutex // the reader answers pings and closes too
+	closeOnce sync.Once
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		msg = []byte(wsNewlines.Replace(string(msg)))
+		c.pending = append(msg, '\n')
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+var wsNewlines = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// reads frames until a whole data message is in.
+// control frames in between are taken care of here.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	text := false
+
+	for {
+		fin, op, payload, err := readFrame(c.r)
+		if err != nil {
+			if err == errWsProtocol || err == errWsTooBig {
+				c.closeWith(1002)
+			}
+			return nil, err
+		}
+
+		switch op {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.closeWith(1000)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if started {
+				c.closeWith(1002)
+				return nil, errWsProtocol
+			}
+			started = true
+			text = op == wsText
+		case wsContinuation:
+			if !started {
+				c.closeWith(1002)
+				return nil, errWsProtocol
+			}
+		default:
+			c.closeWith(1002)
+			return nil, errWsProtocol
+		}
+
+		msg = append(msg, payload...)
+		if len(msg) > wsMaxMessage {
+			c.closeWith(1009)
+			return nil, errWsTooBig
+		}
+		if fin {
+			// only the whole message, a character can be split between frames
+			if text && !utf8.Valid(msg) {
+				c.closeWith(1007)
+				return nil, errWsUTF8
+			}
+			return msg, nil
+		}
+	}
+}
+
+func readFrame(r io.Reader) (fin bool, op byte, payload []byte, err error) {
+	head := make([]byte, 2)
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		return
+	}
+
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		_, err = io.ReadFull(r, b)
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		_, err = io.ReadFull(r, b)
+		length = binary.BigEndian.Uint64(b)
+	}
+	if err != nil {
+		return
+	}
+
+	// clients always mask, and control frames are never fragmented
+	if !masked || (op >= wsClose && (!fin || length > 125)) {
+		err = errWsProtocol
+		return
+	}
+	if length > wsMaxMessage {
+		err = errWsTooBig
+		return
+	}
+
+	mask := make([]byte, 4)
+	_, err = io.ReadFull(r, mask)
+	if err != nil {
+		return
+	}
+
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	for _, line := range lines {
+		err := c.writeFrame(wsText, []byte(line))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// server frames are never masked
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	frame := []byte{0x80 | op}
+	switch l := len(payload); {
+	case l <= 125:
+		frame = append(frame, byte(l))
+	case l <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(l))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(l))
+	}
+	frame = append(frame, payload...)
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) closeWith(code uint16) {
+	c.closeOnce.Do(func() {
+		c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, code))
+	})
+}
+
+// says goodbye properly before hanging up
+func (c *wsConn) Close() error {
+	c.closeWith(1000)
+	return c.Conn.Close()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bare bones client side of the websocket protocol
+type wsClient struct {
+	c net.Conn
+	r *bufio.Reader
+}
+
+func dialWs(t *testing.T, addr string) *wsClient {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	req := "GET /chat HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	_, err = c.Write([]byte(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed with %v", resp.Status)
+	}
+	// example straight from the RFC
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("wrong accept key %v", accept)
+	}
+
+	return &wsClient{c: c, r: r}
+}
+
+func (w *wsClient) send(t *testing.T, op byte, payload string) {
+	t.Helper()
+
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	_, err := w.c.Write(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (w *wsClient) expect(t *testing.T, op byte, want string) {
+	t.Helper()
+
+	head := make([]byte, 2)
+	_, err := io.ReadFull(w.r, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		b := make([]byte, 2)
+		io.ReadFull(w.r, b)
+		length = int(binary.BigEndian.Uint16(b))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(w.r, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head[0]&0x0F != op || string(payload) != want {
+		t.Fatalf("wrong frame. expected %x %q got %x %q", op, want, head[0]&0x0F, payload)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	s := MakeServer(Config{})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	// the usual tcp client
+	alice, aliceConn := makeTestMember("alice")
+	s.Register(alice)
+	s.Join(alice, defaultRoom)
+	aliceConn.expect(t, "* The room contains: \n")
+
+	ws := dialWs(t, addr)
+	ws.expect(t, wsText, "Welcome to budgetchat! What shall I call you?")
+	ws.send(t, wsText, "bob")
+	ws.expect(t, wsText, "* The room contains: alice")
+	aliceConn.expect(t, "* bob has entered the room\n")
+
+	ws.send(t, wsPing, "hey")
+	ws.expect(t, wsPong, "hey")
+
+	ws.send(t, wsText, "hi from the browser")
+	aliceConn.expect(t, "[bob] hi from the browser\n")
+
+	alice.room.SendMessage(alice, "hi from telnet")
+	ws.expect(t, wsText, "[alice] hi from telnet")
+
+	// fragmented message
+	mask := []byte{0, 0, 0, 0}
+	ws.c.Write(append([]byte{wsText, 0x80 | 3}, append(mask, "abc"...)...))
+	ws.c.Write(append([]byte{0x80 | wsContinuation, 0x80 | 3}, append(mask, "def"...)...))
+	aliceConn.expect(t, "[bob] abcdef\n")
+
+	// still one line
+	ws.send(t, wsText, "two\nlines")
+	aliceConn.expect(t, "[bob] two lines\n")
+
+	// the biggest message there is still makes it through the scanner
+	big := strings.Repeat("a", wsMaxMessage)
+	head := []byte{0x80 | wsText, 0x80 | 126}
+	head = binary.BigEndian.AppendUint16(head, uint16(len(big)))
+	ws.c.Write(append(append(head, mask...), big...))
+	aliceConn.expect(t, "[bob] "+big+"\n")
+
+	ws.send(t, wsClose, "")
+	ws.expect(t, wsClose, "\x03\xe8")
+	aliceConn.expect(t, "* bob has left the room\n")
+}
+
+func TestWebSocketBadUTF8(t *testing.T) {
+	s := MakeServer(Config{})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	defer srv.Close()
+
+	ws := dialWs(t, strings.TrimPrefix(srv.URL, "http://"))
+	ws.expect(t, wsText, "Welcome to budgetchat! What shall I call you?")
+	ws.send(t, wsText, "bob\xff")
+	// 1007, invalid frame payload data
+	ws.expect(t, wsClose, "\x03\xef")
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	s := MakeServer(Config{WSOrigins: []string{"https://chat.example.com"}})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	type originCases struct {
+		origin string
+		status int
+	}
+	cases := []originCases{
+		{"", http.StatusSwitchingProtocols},
+		{"http://" + addr, http.StatusSwitchingProtocols},
+		{"https://chat.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("wrong status for origin %q. expected %v got %v", c.origin, c.status, resp.StatusCode)
+		}
+	}
+}
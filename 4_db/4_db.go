@@ -1,15 +1,63 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"protohackers/4_db/kv"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func main() {
+	dataDir := flag.String("data", "db_data", "directory to persist the store in")
+	syncEvery := flag.Duration("sync", 100*time.Millisecond, "how often inserts get fsynced. a crash loses at most this much")
+	snapshotEvery := flag.Duration("snapshot", 5*time.Minute, "how often the whole store gets snapshotted")
+	extended := flag.Bool("extended", false, "accept the extended commands in extended.go. requests starting with \\x01 become commands, so plain keys starting with it can't be used")
+	watchLimit := flag.Int("watch-limit", 16, "watchers allowed per key or prefix")
+	watchPerClient := flag.Int("watch-per-client", 64, "watches (confirmed or not) allowed per client ip")
+	watchLease := flag.Duration("watch-lease", 5*time.Minute, "longest lease a watch can get before it needs renewing")
+	replicateAddr := flag.String("replicate", "", "address to stream changes to replicas from. disabled if empty")
+	follow := flag.String("follow", "", "run as a replica of the primary at this address")
+	replicaInserts := flag.String("replica-inserts", "forward", "what replicas do with inserts. forward (to the primary) or reject")
+	replicaSecret := flag.String("replica-secret", "", "shared secret replicas and the primary authenticate with. needed for -replicate and -follow")
+	workers := flag.Int("workers", runtime.NumCPU(), "goroutines handling requests")
+	verbose := flag.Bool("v", false, "log every request")
+	nsPath := flag.String("namespaces", "", "file mapping client networks to namespaces, see namespace.go. everyone shares one if empty")
+	flag.Parse()
+
+	rules, err := loadNamespaces(*nsPath)
+	if err != nil {
+		panic(err)
+	}
+
+	m, err := kv.Open(*dataDir, "database punya udin 1.0")
+	if err != nil {
+		panic(err)
+	}
+	defer m.Close()
+
+	go func() {
+		for range time.Tick(*syncEvery) {
+			err := m.Sync()
+			if err != nil {
+				log.Println("sync failed:", err)
+			}
+		}
+	}()
+	go func() {
+		for range time.Tick(*snapshotEvery) {
+			err := m.Snapshot()
+			if err != nil {
+				log.Println("snapshot failed:", err)
+			}
+		}
+	}()
+
 	port := 8000
 	// use this instead of ListenPacket since we need to reply
 	// on the same port as we are listening.
@@ -25,35 +73,75 @@ func main() {
 
 	defer c.Close()
 
-	m := make(map[string]string)
-	m["version"] = "database punya udin 1.0"
+	s := &server{
+		store:    m,
+		rules:    rules,
+		extended: *extended,
+		workers:  *workers,
+		verbose:  *verbose,
+		c:        c,
+	}
+	if (*follow != "" || *replicateAddr != "") && *replicaSecret == "" {
+		log.Fatal("-replica-secret is needed to replicate")
+	}
+	if *follow != "" {
+		var forward bool
+		switch *replicaInserts {
+		case "forward":
+			forward = true
+		case "reject":
+			forward = false
+		default:
+			log.Fatalf("unknown replica insert policy %v", *replicaInserts)
+		}
+		s.replica = makeReplica(m, *follow, *replicaSecret, forward)
+		go s.replica.run(context.Background())
+		log.Println("Following", *follow)
+	}
 
-	for {
-		b := make([]byte, 1000)
-		_, addr, err := c.ReadFromUDP(b)
+	if *replicateAddr != "" {
+		ln, err := net.Listen("tcp", *replicateAddr)
 		if err != nil {
 			panic(err)
 		}
-		log.Println("recv from: ", addr)
+		defer ln.Close()
+		go makePrimary(s, *replicaSecret).serve(ln)
+		log.Println("Replicating at", *replicateAddr)
+	}
 
-		// "udin\0" != "udin"
-		// gotta remove the nulls first
-		b = bytes.Trim(b, "\000")
+	if *extended {
+		s.watches = makeWatcher(*watchLimit, *watchPerClient, *watchLease)
+		go func() {
+			for range time.Tick(watchChallengeTimeout) {
+				s.watches.sweep()
+			}
+		}()
+	}
 
-		ins, ret := ParseRequest(string(b))
+	err = s.serve()
+	if err != nil {
+		panic(err)
+	}
+}
 
-		if ins != nil && ins.Key != "version" {
-			m[ins.Key] = ins.Value
-			log.Println("ins for", ins.Key, ":", ins.Value)
-		}
+// requests and responses both have to be shorter than this
+const maxDatagram = 1000
 
-		if ret != nil {
-			retval := fmt.Sprintf("%v=%v", ret.Key, m[ret.Key])
+var (
+	ErrResponseTooBig = fmt.Errorf("response would not fit in a datagram")
+)
 
-			c.WriteToUDP([]byte(retval), addr)
-			log.Println("ret for", ret.Key, ":", m[ret.Key])
-		}
+// "key=value" for a retrieve.
+//
+// keys and values always fit on their own since the request was under the limit,
+// but a long key with a long value might not.
+// we can't send half an answer, so those get no answer at all, same as a lost packet.
+func makeResponse(key string, value string) ([]byte, error) {
+	b := []byte(key + "=" + value)
+	if len(b) >= maxDatagram {
+		return nil, ErrResponseTooBig
 	}
+	return b, nil
 }
 
 type Insert struct {
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"protohackers/4_db/kv"
+	"strings"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	type parseCases struct {
+		in  string
+		ins *Insert
+		ret *Retrieve
+	}
+
+	cases := []parseCases{
+		{"foo=bar", &Insert{"foo", "bar"}, nil},
+		{"foo=bar=baz", &Insert{"foo", "bar=baz"}, nil},
+		{"=foo", &Insert{"", "foo"}, nil},
+		{"foo=", &Insert{"foo", ""}, nil},
+		{"foo", nil, &Retrieve{"foo"}},
+		{"", nil, &Retrieve{""}},
+		// NULs are just bytes like any other
+		{"\x00foo\x00=\x00bar\x00", &Insert{"\x00foo\x00", "\x00bar\x00"}, nil},
+		{"\x00\x00", nil, &Retrieve{"\x00\x00"}},
+	}
+
+	for _, c := range cases {
+		ins, ret := ParseRequest(c.in)
+		if (ins == nil) != (c.ins == nil) || (ins != nil && *ins != *c.ins) {
+			t.Fatalf("wrong insert for %q. expected %v got %v", c.in, c.ins, ins)
+		}
+		if (ret == nil) != (c.ret == nil) || (ret != nil && *ret != *c.ret) {
+			t.Fatalf("wrong retrieve for %q. expected %v got %v", c.in, c.ret, ret)
+		}
+	}
+}
+
+func TestMakeResponse(t *testing.T) {
+	type responseCases struct {
+		key   string
+		value string
+		err   error
+	}
+
+	cases := []responseCases{
+		{"foo", "bar", nil},
+		{"\x00", "\x00", nil},
+		{strings.Repeat("k", 500), strings.Repeat("v", 498), nil},
+		{strings.Repeat("k", 500), strings.Repeat("v", 499), ErrResponseTooBig},
+	}
+
+	for _, c := range cases {
+		out, err := makeResponse(c.key, c.value)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("wrong error for %v byte key and %v byte value. expected %v got %v", len(c.key), len(c.value), c.err, err)
+		}
+		if err == nil && string(out) != c.key+"="+c.value {
+			t.Fatalf("wrong response. expected %q got %q", c.key+"="+c.value, out)
+		}
+	}
+}
+
+func TestExtended(t *testing.T) {
+	m := kv.NewStore("1.0").Namespace("")
+
+	type extendedCases struct {
+		in    string
+		reply string
+	}
+
+	cases := []extendedCases{
+		{"\x01set\x00bin\x000\x00a\x00b", "\x01ok"},
+		{"\x01set\x00foo\x0060\x00bar", "\x01ok"},
+		{"\x01cas\x00foo\x00nope\x00qux", "\x01conflict\x00bar"},
+		{"\x01cas\x00foo\x00bar\x00qux\x00quux", "\x01ok"},
+		{"\x01incr\x00hits", "\x01ok\x001"},
+		{"\x01incr\x00hits\x0010", "\x01ok\x0011"},
+		{"\x01decr\x00hits\x003", "\x01ok\x008"},
+		{"\x01incr\x00foo", "\x01conflict"},
+		{"\x01del\x00foo", "\x01ok"},
+		{"\x01del\x00foo", "\x01conflict"},
+		{"\x01del\x00version", "\x01error\x00key is read only"},
+		{"\x01set\x00foo\x00-1\x00bar", "\x01error\x00bad command"},
+		{"\x01flush", "\x01error\x00bad command"},
+		// a plain insert of a key starting with \x01 is taken as a command
+		{"\x01key=value", "\x01error\x00bad command"},
+	}
+
+	for _, c := range cases {
+		var reply []byte
+		cmd, err := ParseExtended(c.in)
+		if err != nil {
+			reply = extendedReply("error", err.Error())
+		} else {
+			reply = execute(m, cmd)
+		}
+		if string(reply) != c.reply {
+			t.Fatalf("wrong reply for %q. expected %q got %q", c.in, c.reply, reply)
+		}
+	}
+
+	v, _ := m.Get("bin")
+	if v != "a\x00b" {
+		t.Fatalf("wrong value for bin. expected %q got %q", "a\x00b", v)
+	}
+}
+
+func TestScanReplies(t *testing.T) {
+	type scanCases struct {
+		pairs []kv.Pair
+		total int
+	}
+
+	big := strings.Repeat("v", 400)
+	cases := []scanCases{
+		{[]kv.Pair{}, 1},
+		{[]kv.Pair{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}, 1},
+		{[]kv.Pair{{Key: "a", Value: big}, {Key: "b", Value: big}, {Key: "c", Value: big}}, 2},
+		// can't fit anywhere
+		{[]kv.Pair{{Key: "a", Value: "1"}, {Key: "b", Value: strings.Repeat("v", 990)}}, 1},
+	}
+
+	for _, c := range cases {
+		out := scanReplies(c.pairs)
+		if len(out) != c.total {
+			t.Fatalf("wrong number of datagrams for %v pairs. expected %v got %v", len(c.pairs), c.total, len(out))
+		}
+		for i, d := range out {
+			if len(d) >= maxDatagram {
+				t.Fatalf("datagram %v is %v bytes", i, len(d))
+			}
+			header := fmt.Sprintf("\x01scan\x00%v\x00%v\x00", i+1, c.total)
+			if !strings.HasPrefix(string(d), header) {
+				t.Fatalf("wrong header. expected %q got %q", header, d)
+			}
+		}
+	}
+
+	out := scanReplies([]kv.Pair{{Key: "svc.foo.a", Value: "1"}, {Key: "svc.foo.b", Value: "x=y"}})
+	exp := "\x01scan\x001\x001\x0011:svc.foo.a=113:svc.foo.b=x=y"
+	if string(out[0]) != exp {
+		t.Fatalf("wrong scan reply. expected %q got %q", exp, out[0])
+	}
+}
+
+func TestNamespaceLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ns.txt")
+	os.WriteFile(path, []byte("# teams\n10.1.0.0/16 teamA\n10.0.0.0/8 teamB\n"), 0o644)
+
+	rules, err := loadNamespaces(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type lookupCases struct {
+		ip string
+		ns string
+	}
+
+	cases := []lookupCases{
+		{"10.1.2.3", "teamA"},
+		{"10.2.2.3", "teamB"},
+		{"192.168.1.1", ""},
+	}
+
+	for _, c := range cases {
+		out := rules.lookup(net.ParseIP(c.ip))
+		if out != c.ns {
+			t.Fatalf("wrong namespace for %v. expected %q got %q", c.ip, c.ns, out)
+		}
+	}
+}
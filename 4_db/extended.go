@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"protohackers/4_db/kv"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadCommand = fmt.Errorf("bad command")
+)
+
+// Opt in commands on top of the plain insert/retrieve, enabled with -extended.
+//
+// They start with a byte no sane plain request starts with, followed by the op and its fields, separated by NULs.
+// Keys are binary safe though, so with -extended on a plain insert or retrieve of a key starting with it gets parsed
+// as a command (and most likely answered with an error) instead:
+//
+//	\x01set\x00key\x00ttl seconds\x00value     set with a TTL, 0 means none
+//	\x01incr\x00key\x00delta                   add to an integer, delta defaults to 1
+//	\x01decr\x00key\x00delta                   same but subtracts
+//	\x01cas\x00key\x00expected\x00value        set only if the key currently holds expected
+//	\x01del\x00key
+//	\x01scan\x00prefix                         every key starting with prefix
+//	\x01watch\x00mode\x00lease\x00key          push changes to key. mode is "key" or "prefix"
+//	\x01confirm\x00token                      turns on a new watch, with the token from its challenge
+//	\x01unwatch\x00mode\x00key
+//
+// The last field takes the rest of the datagram, so values can still have NULs in them.
+// Keys and the expected value of a cas can't.
+//
+// Replies start with the same byte:
+//
+//	\x01ok                                     plus \x00 and the new number for incr/decr
+//	\x01conflict        plus \x00 and the current value for cas
+//	\x01challenge\x00token                     a new watch has to be confirmed first
+//	\x01error\x00why
+//
+// Scans get one or more of these instead, sorted by key:
+//
+//	\x01scan\x00seq\x00total\x00pairs
+//
+// seq counts from 1 up to total, and pairs are "<length>:key=value" back to back.
+// UDP can reorder or lose some, so check you got all of them.
+// Pairs that wouldn't fit in a datagram on their own are left out, same as an oversize retrieve.
+//
+// Watching is described in watch.go.
+const extendedPrefix = "\x01"
+
+type Command struct {
+	Op     string
+	Key    string // the key, the prefix for scans and prefix watches, or the token for confirms
+	TTL    time.Duration
+	Delta  int64
+	Expect string
+	Value  string
+	Prefix bool          // watches only
+	Lease  time.Duration // watches only
+}
+
+func ParseExtended(s string) (*Command, error) {
+	body, ok := strings.CutPrefix(s, extendedPrefix)
+	if !ok {
+		return nil, ErrBadCommand
+	}
+	op, rest, _ := strings.Cut(body, "\x00")
+	cmd := &Command{Op: op}
+
+	switch op {
+	case "set":
+		fields := strings.SplitN(rest, "\x00", 3)
+		if len(fields) != 3 {
+			return nil, ErrBadCommand
+		}
+		secs, err := strconv.Atoi(fields[1])
+		if err != nil || secs < 0 {
+			return nil, ErrBadCommand
+		}
+		cmd.Key = fields[0]
+		cmd.TTL = time.Duration(secs) * time.Second
+		cmd.Value = fields[2]
+
+	case "incr", "decr":
+		key, delta, found := strings.Cut(rest, "\x00")
+		cmd.Key = key
+		cmd.Delta = 1
+		if found {
+			d, err := strconv.ParseInt(delta, 10, 64)
+			if err != nil {
+				return nil, ErrBadCommand
+			}
+			cmd.Delta = d
+		}
+		if op == "decr" {
+			cmd.Delta = -cmd.Delta
+		}
+
+	case "cas":
+		fields := strings.SplitN(rest, "\x00", 3)
+		if len(fields) != 3 {
+			return nil, ErrBadCommand
+		}
+		cmd.Key = fields[0]
+		cmd.Expect = fields[1]
+		cmd.Value = fields[2]
+
+	case "del", "scan", "confirm":
+		if strings.Contains(rest, "\x00") {
+			return nil, ErrBadCommand
+		}
+		cmd.Key = rest
+
+	case "watch":
+		fields := strings.SplitN(rest, "\x00", 3)
+		if len(fields) != 3 {
+			return nil, ErrBadCommand
+		}
+		prefix, err := parseWatchMode(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		secs, err := strconv.Atoi(fields[1])
+		if err != nil || secs <= 0 {
+			return nil, ErrBadCommand
+		}
+		cmd.Prefix = prefix
+		cmd.Lease = time.Duration(secs) * time.Second
+		cmd.Key = fields[2]
+
+	case "unwatch":
+		mode, key, found := strings.Cut(rest, "\x00")
+		if !found {
+			return nil, ErrBadCommand
+		}
+		prefix, err := parseWatchMode(mode)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Prefix = prefix
+		cmd.Key = key
+
+	default:
+		return nil, ErrBadCommand
+	}
+	return cmd, nil
+}
+
+func parseWatchMode(mode string) (bool, error) {
+	switch mode {
+	case "key":
+		return false, nil
+	case "prefix":
+		return true, nil
+	default:
+		return false, ErrBadCommand
+	}
+}
+
+// runs the command and returns the reply
+// scans are handled by scanReplies instead, watches by the watcher.
+func execute(m *kv.Namespace, cmd *Command) []byte {
+	var err error
+	var extra string
+
+	switch cmd.Op {
+	case "set":
+		err = m.InsertTTL(cmd.Key, cmd.Value, cmd.TTL)
+	case "incr", "decr":
+		var n int64
+		n, err = m.Incr(cmd.Key, cmd.Delta)
+		if err == nil {
+			extra = strconv.FormatInt(n, 10)
+		}
+	case "cas":
+		var current string
+		current, err = m.CompareAndSwap(cmd.Key, cmd.Expect, cmd.Value)
+		if errors.Is(err, kv.ErrConflict) {
+			extra = current
+		}
+	case "del":
+		err = m.Delete(cmd.Key)
+	}
+
+	switch {
+	case err == nil:
+		return extendedReply("ok", extra)
+	case errors.Is(err, kv.ErrConflict):
+		return extendedReply("conflict", extra)
+	default:
+		return extendedReply("error", err.Error())
+	}
+}
+
+func extendedReply(status string, extra string) []byte {
+	if extra == "" {
+		return []byte(extendedPrefix + status)
+	}
+	return []byte(extendedPrefix + status + "\x00" + extra)
+}
+
+// room for the "\x01scan\x00seq\x00total\x00" header, whatever the numbers end up being
+const scanHeaderRoom = 32
+
+// packs the pairs into as few datagrams as possible
+func scanReplies(pairs []kv.Pair) [][]byte {
+	bodies := make([][]byte, 0)
+	body := make([]byte, 0)
+	for _, p := range pairs {
+		line := p.Key + "=" + p.Value
+		pair := []byte(strconv.Itoa(len(line)) + ":" + line)
+		if scanHeaderRoom+len(pair) >= maxDatagram {
+			log.Printf("leaving %q out of the scan, it is too big", p.Key)
+			continue
+		}
+
+		if scanHeaderRoom+len(body)+len(pair) >= maxDatagram {
+			bodies = append(bodies, body)
+			body = make([]byte, 0)
+		}
+		body = append(body, pair...)
+	}
+	bodies = append(bodies, body)
+
+	ret := make([][]byte, 0, len(bodies))
+	for i, body := range bodies {
+		header := fmt.Sprintf("%vscan\x00%v\x00%v\x00", extendedPrefix, i+1, len(bodies))
+		ret = append(ret, append([]byte(header), body...))
+	}
+	return ret
+}
@@ -0,0 +1,229 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	errCorrupt = fmt.Errorf("corrupt record")
+)
+
+// Append only log of the inserts that are not in a snapshot yet.
+//
+// Each log belongs to one generation. Once snapshot N is written,
+// log N is not needed anymore. The store moves on to log N+1 right before taking the snapshot.
+//
+// Inserts are buffered and only hit the disk on sync,
+// so a crash loses whatever came in since the last one.
+//
+// Record layout:
+//
+//	op (1) | seq uint64 | expires int64 | namespace length (1) | key length uint32 | value length uint32 | namespace | key | value | crc32 of everything before it
+//
+// seq numbers every change the store ever made, it is what replicas go by.
+// expires is in unix nanoseconds, 0 means never.
+// deletes have no value.
+type wal struct {
+	id int
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func logName(id int) string {
+	return fmt.Sprintf("log-%06d.log", id)
+}
+
+// replays every complete record in the log.
+// a half written or corrupt record at the tail (crashed mid write) ends the replay.
+// returns the size of the log up to the last good record.
+func replayLog(path string, fn func(r record)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	size, err := readRecords(bufio.NewReader(f), fn)
+	// the tail is the only place a crash can leave garbage, whatever came before it is fine
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errCorrupt) {
+		return size, nil
+	}
+	return size, err
+}
+
+// reads records until the end, or the first one that is cut off or corrupt.
+// returns the size of everything read up to there.
+func readRecords(r io.Reader, fn func(r record)) (int64, error) {
+	var size int64
+	for {
+		rec, n, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		fn(rec)
+		size += int64(n)
+	}
+}
+
+// open the log for appending.
+// anything after size is thrown away.
+func openLog(dir string, id int, size int64) (*wal, error) {
+	f, err := os.OpenFile(filepath.Join(dir, logName(id)), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	_, err = f.Seek(size, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wal{
+		id: id,
+		f:  f,
+		w:  bufio.NewWriter(f),
+	}, nil
+}
+
+func (l *wal) append(r record) error {
+	_, err := l.w.Write(r.encode())
+	return err
+}
+
+// gets everything buffered to the OS. doesn't fsync.
+func (l *wal) flush() error {
+	return l.w.Flush()
+}
+
+func (l *wal) close() error {
+	err := l.w.Flush()
+	if err == nil {
+		err = l.f.Sync()
+	}
+	l.f.Close()
+	return err
+}
+
+const (
+	opSet byte = iota + 1
+	opDelete
+)
+
+type record struct {
+	op      byte
+	seq     uint64
+	ns      string
+	key     string
+	value   string
+	expires int64
+}
+
+func (r record) encode() []byte {
+	b := make([]byte, 0, recordHeader+len(r.ns)+len(r.key)+len(r.value)+4)
+	b = append(b, r.op)
+	b = binary.BigEndian.AppendUint64(b, r.seq)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.expires))
+	b = append(b, byte(len(r.ns)))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(r.key)))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(r.value)))
+	b = append(b, r.ns...)
+	b = append(b, r.key...)
+	b = append(b, r.value...)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	return b
+}
+
+const recordHeader = 1 + 8 + 8 + 1 + 4 + 4
+
+// returns the number of bytes read alongside the record
+func readRecord(r io.Reader) (record, int, error) {
+	var rec record
+
+	header := make([]byte, recordHeader)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return rec, 0, err
+	}
+	rec.op = header[0]
+	rec.seq = binary.BigEndian.Uint64(header[1:9])
+	rec.expires = int64(binary.BigEndian.Uint64(header[9:17]))
+	nl := int(header[17])
+	kl := binary.BigEndian.Uint32(header[18:22])
+	vl := binary.BigEndian.Uint32(header[22:26])
+
+	// nothing we write comes close. must be garbage.
+	if uint64(kl)+uint64(vl) > maxRecord || (rec.op != opSet && rec.op != opDelete) {
+		return rec, 0, errCorrupt
+	}
+
+	l := nl + int(kl) + int(vl)
+	b := make([]byte, l+4)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return rec, 0, io.ErrUnexpectedEOF
+	}
+
+	body := b[:l]
+	sum := binary.BigEndian.Uint32(b[l:])
+	if crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, body) != sum {
+		return rec, 0, errCorrupt
+	}
+
+	rec.ns = string(body[:nl])
+	rec.key = string(body[nl : nl+int(kl)])
+	rec.value = string(body[nl+int(kl):])
+	return rec, len(header) + len(b), nil
+}
+
+// One change to the store, as handed to replicas.
+type Change struct {
+	Seq       uint64
+	Delete    bool
+	Namespace string
+	Key       string
+	Value     string
+	Expires   int64 // unix nanoseconds, 0 means never
+}
+
+func (r record) change() Change {
+	return Change{
+		Seq:       r.seq,
+		Delete:    r.op == opDelete,
+		Namespace: r.ns,
+		Key:       r.key,
+		Value:     r.value,
+		Expires:   r.expires,
+	}
+}
+
+func (c Change) record() record {
+	op := opSet
+	if c.Delete {
+		op = opDelete
+	}
+	return record{
+		op:      op,
+		seq:     c.Seq,
+		ns:      c.Namespace,
+		key:     c.Key,
+		value:   c.Value,
+		expires: c.Expires,
+	}
+}
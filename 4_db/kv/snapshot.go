@@ -0,0 +1,134 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+var (
+	errInvalidSnapshot = fmt.Errorf("invalid snapshot file")
+)
+
+const snapshotMagic = "KVSN"
+
+// Every key in the store as of the end of log N.
+//
+// Layout:
+//
+//	"KVSN" | seq uint64 | record...
+//
+// seq is the last change the snapshot includes.
+// records are the same as in the log, sets only.
+// snapshots only show up under their real name once fully synced, so they are never torn.
+func snapshotName(id int) string {
+	return fmt.Sprintf("snapshot-%06d.snap", id)
+}
+
+// generations of every snapshot in dir, oldest first
+func listSnapshots(dir string) ([]int, error) {
+	return listGenerations(dir, "snapshot-*.snap", "snapshot-%06d.snap")
+}
+
+func listLogs(dir string) ([]int, error) {
+	return listGenerations(dir, "log-*.log", "log-%06d.log")
+}
+
+func listGenerations(dir string, pattern string, format string) ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(paths))
+	for _, p := range paths {
+		var id int
+		_, err := fmt.Sscanf(filepath.Base(p), format, &id)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// returns the seq of the snapshot
+func readSnapshot(path string, fn func(r record)) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, len(snapshotMagic)+8)
+	_, err = io.ReadFull(r, header)
+	if err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, errInvalidSnapshot
+	}
+	seq := binary.BigEndian.Uint64(header[len(snapshotMagic):])
+
+	// snapshots are never torn, so anything wrong in there means the data after it is gone
+	_, err = readRecords(r, fn)
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errCorrupt) {
+		return 0, errInvalidSnapshot
+	}
+	return seq, err
+}
+
+// writes data as snapshot id.
+// goes through a temporary file so a crash never leaves half a snapshot behind.
+func writeSnapshot(dir string, id int, seq uint64, data map[nsKey]entry) error {
+	path := filepath.Join(dir, snapshotName(id))
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	w.WriteString(snapshotMagic)
+	binary.Write(w, binary.BigEndian, seq)
+	for k, e := range data {
+		w.Write(record{
+			op:      opSet,
+			ns:      k.ns,
+			key:     k.key,
+			value:   e.value,
+			expires: e.expires,
+		}.encode())
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,718 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReadOnlyKey = fmt.Errorf("key is read only")
+	// the key doesn't hold what the caller expected
+	ErrConflict = fmt.Errorf("conflict")
+	// the changes asked for only live in a snapshot now
+	ErrCompacted = fmt.Errorf("changes were compacted away")
+	// a replicated change that doesn't come right after the last one
+	ErrOutOfOrder = fmt.Errorf("change out of order")
+)
+
+// the one key clients can't change
+const VersionKey = "version"
+
+// records are bounded by the size of a datagram.
+// anything way bigger than that in a log is garbage.
+const maxRecord = 1 << 20
+
+// Key value store for the unusual database program.
+//
+// Stores made with Open are also backed by a directory.
+// Every change goes to the log first, then to the map.
+// The log is only fsynced on Sync, so call that often.
+// Snapshot writes the whole map out so older logs can go.
+//
+// On startup the newest snapshot is loaded, then every log after it is replayed on top.
+//
+// Keys are spread over shards, each with its own lock, so reads and writes on different keys don't wait on each other.
+// Writes only line up for the short bit where they get a seq and go to the log.
+// Locks are always taken shard first, then mu. Whatever needs the whole map locks every shard in order.
+type Store struct {
+	shards  [numShards]*shard
+	seed    maphash.Seed
+	version string
+	seq     uint64       // last change made
+	mu      sync.RWMutex // seq, followers and the log
+
+	followers    map[int]func(Change)
+	nextFollower int
+
+	// only used by stores backed by a directory
+	dir     string
+	log     *wal
+	snapGen int        // generation of the newest snapshot, 0 if there is none
+	snapSeq uint64     // last change in the newest snapshot. the logs have everything after it.
+	snapMu  sync.Mutex // one snapshot at a time
+}
+
+const numShards = 64
+
+type shard struct {
+	data map[nsKey]entry
+	mu   sync.RWMutex
+}
+
+type nsKey struct {
+	ns  string
+	key string
+}
+
+type entry struct {
+	value   string
+	expires int64 // unix nanoseconds, 0 means never
+}
+
+func (e entry) expired(now time.Time) bool {
+	return e.expires != 0 && now.UnixNano() >= e.expires
+}
+
+// in memory only store
+func NewStore(version string) *Store {
+	s := &Store{
+		seed:      maphash.MakeSeed(),
+		version:   version,
+		followers: make(map[int]func(Change)),
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			data: make(map[nsKey]entry),
+		}
+	}
+	return s
+}
+
+func (s *Store) shard(k nsKey) *shard {
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	h.WriteString(k.ns)
+	h.WriteByte(0)
+	h.WriteString(k.key)
+	return s.shards[h.Sum64()%numShards]
+}
+
+// locks every shard for writing, then the store. unlock with unlockAll.
+func (s *Store) lockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+	s.mu.Lock()
+}
+
+func (s *Store) unlockAll() {
+	s.mu.Unlock()
+	for _, sh := range s.shards {
+		sh.mu.Unlock()
+	}
+}
+
+// same as lockAll, for reading
+func (s *Store) rlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+	s.mu.RLock()
+}
+
+func (s *Store) runlockAll() {
+	s.mu.RUnlock()
+	for _, sh := range s.shards {
+		sh.mu.RUnlock()
+	}
+}
+
+// opens the store persisted in dir, creating it if needed.
+func Open(dir string, version string) (*Store, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewStore(version)
+	s.dir = dir
+
+	snaps, err := listSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	snap := 0
+	if len(snaps) > 0 {
+		snap = snaps[len(snaps)-1]
+		seq, err := readSnapshot(filepath.Join(dir, snapshotName(snap)), s.apply)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", snapshotName(snap), err)
+		}
+		s.snapGen = snap
+		s.snapSeq = seq
+		s.seq = seq
+	}
+
+	logs, err := listLogs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	gen := snap + 1
+	var size int64
+	for _, id := range logs {
+		if id <= snap {
+			continue
+		}
+		size, err = replayLog(filepath.Join(dir, logName(id)), func(r record) {
+			s.apply(r)
+			s.seq = r.seq
+		})
+		if err != nil {
+			return nil, err
+		}
+		gen = id
+	}
+
+	s.log, err = openLog(dir, gen, size)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cleanup(snap)
+	return s, nil
+}
+
+// drops snapshots older than snap, and the logs it covers
+func (s *Store) cleanup(snap int) {
+	snaps, _ := listSnapshots(s.dir)
+	for _, id := range snaps {
+		if id < snap {
+			os.Remove(filepath.Join(s.dir, snapshotName(id)))
+		}
+	}
+	logs, _ := listLogs(s.dir)
+	for _, id := range logs {
+		if id <= snap {
+			os.Remove(filepath.Join(s.dir, logName(id)))
+		}
+	}
+}
+
+// needs the key's shard locked, or nobody else using the store
+func (s *Store) apply(r record) {
+	if r.key == VersionKey {
+		return
+	}
+
+	k := nsKey{r.ns, r.key}
+	s.shard(k).apply(k, r)
+}
+
+func (sh *shard) apply(k nsKey, r record) {
+	switch r.op {
+	case opSet:
+		sh.data[k] = entry{
+			value:   r.value,
+			expires: r.expires,
+		}
+	case opDelete:
+		delete(sh.data, k)
+	}
+}
+
+// logs the change, lets the followers know, then applies it.
+// needs the key's shard locked. takes the store lock itself.
+// records without a seq get the next one, the ones with a seq have to come right after the last change.
+func (s *Store) write(sh *shard, r record) error {
+	s.mu.Lock()
+	if r.seq == 0 {
+		r.seq = s.seq + 1
+	}
+	if r.seq != s.seq+1 {
+		s.mu.Unlock()
+		return ErrOutOfOrder
+	}
+	if s.log != nil {
+		err := s.log.append(r)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.seq = r.seq
+
+	for _, fn := range s.followers {
+		fn(r.change())
+	}
+	s.mu.Unlock()
+
+	// nobody can read the key until the shard is unlocked anyway
+	if r.key != VersionKey {
+		sh.apply(nsKey{r.ns, r.key}, r)
+	}
+	return nil
+}
+
+// value of the key if it is there and not expired. needs at least the read lock on the shard.
+func (sh *shard) get(k nsKey) (entry, bool) {
+	e, ok := sh.data[k]
+	if !ok || e.expired(time.Now()) {
+		return entry{}, false
+	}
+	return e, true
+}
+
+// Keys in one namespace never clash with keys in another.
+// The store's own methods work on the default namespace, the empty one.
+//
+// The version key is the same in every namespace.
+type Namespace struct {
+	s    *Store
+	name string
+}
+
+// names are at most MaxNamespace bytes
+func (s *Store) Namespace(name string) *Namespace {
+	return &Namespace{
+		s:    s,
+		name: name,
+	}
+}
+
+// longest namespace name that fits in a record
+const MaxNamespace = 255
+
+type Pair struct {
+	Key   string
+	Value string
+}
+
+func (s *Store) Insert(key string, value string) error {
+	return s.Namespace("").Insert(key, value)
+}
+
+func (s *Store) InsertTTL(key string, value string, ttl time.Duration) error {
+	return s.Namespace("").InsertTTL(key, value, ttl)
+}
+
+func (s *Store) Get(key string) (string, bool) {
+	return s.Namespace("").Get(key)
+}
+
+func (s *Store) Incr(key string, delta int64) (int64, error) {
+	return s.Namespace("").Incr(key, delta)
+}
+
+func (s *Store) CompareAndSwap(key string, expected string, value string) (string, error) {
+	return s.Namespace("").CompareAndSwap(key, expected, value)
+}
+
+func (s *Store) Delete(key string) error {
+	return s.Namespace("").Delete(key)
+}
+
+func (s *Store) Scan(prefix string) []Pair {
+	return s.Namespace("").Scan(prefix)
+}
+
+// sets the key for good, clearing any TTL it had
+func (n *Namespace) Insert(key string, value string) error {
+	return n.InsertTTL(key, value, 0)
+}
+
+// sets the key, which goes away after ttl. 0 means it never does.
+func (n *Namespace) InsertTTL(key string, value string, ttl time.Duration) error {
+	if key == VersionKey {
+		return ErrReadOnlyKey
+	}
+
+	k := nsKey{n.name, key}
+	sh := n.s.shard(k)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	r := record{
+		op:    opSet,
+		ns:    n.name,
+		key:   key,
+		value: value,
+	}
+	if ttl > 0 {
+		r.expires = time.Now().Add(ttl).UnixNano()
+	}
+	return n.s.write(sh, r)
+}
+
+// false if the key was never inserted, or expired
+func (n *Namespace) Get(key string) (string, bool) {
+	if key == VersionKey {
+		return n.s.version, true
+	}
+
+	k := nsKey{n.name, key}
+	sh := n.s.shard(k)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, ok := sh.get(k)
+	return e.value, ok
+}
+
+// adds delta to the integer in the key and returns the result.
+// missing keys count as 0. the key keeps its TTL.
+// returns ErrConflict if the key holds something that isn't an integer.
+func (n *Namespace) Incr(key string, delta int64) (int64, error) {
+	if key == VersionKey {
+		return 0, ErrReadOnlyKey
+	}
+
+	k := nsKey{n.name, key}
+	sh := n.s.shard(k)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.get(k)
+	var i int64
+	if ok {
+		var err error
+		i, err = strconv.ParseInt(e.value, 10, 64)
+		if err != nil {
+			return 0, ErrConflict
+		}
+	}
+	i += delta
+
+	err := n.s.write(sh, record{
+		op:      opSet,
+		ns:      n.name,
+		key:     key,
+		value:   strconv.FormatInt(i, 10),
+		expires: e.expires,
+	})
+	return i, err
+}
+
+// sets the key to value only if it currently holds expected.
+// missing keys hold the empty string as far as this is concerned.
+// returns what the key holds afterwards, along with ErrConflict if it didn't match.
+func (n *Namespace) CompareAndSwap(key string, expected string, value string) (string, error) {
+	if key == VersionKey {
+		return "", ErrReadOnlyKey
+	}
+
+	k := nsKey{n.name, key}
+	sh := n.s.shard(k)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, _ := sh.get(k)
+	if e.value != expected {
+		return e.value, ErrConflict
+	}
+
+	err := n.s.write(sh, record{
+		op:    opSet,
+		ns:    n.name,
+		key:   key,
+		value: value,
+	})
+	return value, err
+}
+
+// returns ErrConflict if the key wasn't there to begin with
+func (n *Namespace) Delete(key string) error {
+	if key == VersionKey {
+		return ErrReadOnlyKey
+	}
+
+	k := nsKey{n.name, key}
+	sh := n.s.shard(k)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	_, ok := sh.get(k)
+	if !ok {
+		return ErrConflict
+	}
+	return n.s.write(sh, record{
+		op:  opDelete,
+		ns:  n.name,
+		key: key,
+	})
+}
+
+// every key starting with prefix along with its value, sorted by key.
+// goes through the whole namespace, which is fine for a config store.
+// shards are read one at a time, so writes landing during the scan may or may not show up.
+func (n *Namespace) Scan(prefix string) []Pair {
+	ret := make([]Pair, 0)
+	if strings.HasPrefix(VersionKey, prefix) {
+		ret = append(ret, Pair{VersionKey, n.s.version})
+	}
+
+	now := time.Now()
+	for _, sh := range n.s.shards {
+		sh.mu.RLock()
+		for k, e := range sh.data {
+			if k.ns != n.name || !strings.HasPrefix(k.key, prefix) || e.expired(now) {
+				continue
+			}
+			ret = append(ret, Pair{k.key, e.value})
+		}
+		sh.mu.RUnlock()
+	}
+
+	slices.SortFunc(ret, func(a, b Pair) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return ret
+}
+
+// makes every change so far durable.
+// writers only wait on the lock for the flush, not the fsync.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	if s.log == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	err := s.log.flush()
+	f := s.log.f
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	// a snapshot swapped the log out from under us. it synced the log before closing it.
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// writes every key to a snapshot and throws away the logs it covers.
+// expired keys are dropped for good here.
+// changes keep going to a fresh log while the snapshot is written.
+// does nothing for in memory stores.
+func (s *Store) Snapshot() error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.lockAll()
+	if s.log == nil {
+		s.unlockAll()
+		return nil
+	}
+	snap, err := s.rotate()
+	if err != nil {
+		s.unlockAll()
+		return err
+	}
+
+	now := time.Now()
+	data := make(map[nsKey]entry)
+	for _, sh := range s.shards {
+		maps.DeleteFunc(sh.data, func(k nsKey, e entry) bool {
+			return e.expired(now)
+		})
+		maps.Copy(data, sh.data)
+	}
+	seq := s.seq
+	s.unlockAll()
+
+	return s.finishSnapshot(snap, seq, data)
+}
+
+// moves on to the next log. returns the generation of the one just closed.
+// needs snapMu and mu.
+func (s *Store) rotate() (int, error) {
+	snap := s.log.id
+	next, err := openLog(s.dir, snap+1, 0)
+	if err != nil {
+		return 0, err
+	}
+	err = s.log.close()
+	s.log = next
+	return snap, err
+}
+
+// needs snapMu
+func (s *Store) finishSnapshot(snap int, seq uint64, data map[nsKey]entry) error {
+	err := writeSnapshot(s.dir, snap, seq, data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.snapGen = snap
+	s.snapSeq = seq
+	s.mu.Unlock()
+
+	s.cleanup(snap)
+	return nil
+}
+
+// last change made to the store
+func (s *Store) Seq() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seq
+}
+
+// calls fn with every change from now on, in order.
+// fn is called with the store locked, so it must not block or use the store.
+// returns the last change made before fn was added, and a func to stop following.
+func (s *Store) Follow(fn func(Change)) (uint64, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.nextFollower
+	s.nextFollower++
+	s.followers[id] = fn
+
+	return s.seq, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.followers, id)
+	}
+}
+
+// every change after from, read back from the logs.
+// returns ErrCompacted if some of them only made it into a snapshot, and for in memory stores.
+func (s *Store) Changes(from uint64) ([]Change, error) {
+	// keeps snapshots from deleting the logs while we read them
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.mu.Lock()
+	if s.log == nil || from < s.snapSeq {
+		s.mu.Unlock()
+		return nil, ErrCompacted
+	}
+	err := s.log.flush()
+	snap := s.snapGen
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := listLogs(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Change, 0)
+	for _, id := range logs {
+		if id <= snap {
+			continue
+		}
+		_, err := replayLog(filepath.Join(s.dir, logName(id)), func(r record) {
+			if r.seq > from {
+				ret = append(ret, r.change())
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// every key in every namespace as a change, along with the last change they include.
+// handing these to Restore gets another store to the same state.
+func (s *Store) Dump() (uint64, []Change) {
+	s.rlockAll()
+	defer s.runlockAll()
+
+	now := time.Now()
+	ret := make([]Change, 0)
+	for _, sh := range s.shards {
+		for k, e := range sh.data {
+			if e.expired(now) {
+				continue
+			}
+			ret = append(ret, Change{
+				Namespace: k.ns,
+				Key:       k.key,
+				Value:     e.value,
+				Expires:   e.expires,
+			})
+		}
+	}
+	return s.seq, ret
+}
+
+// makes a change some other store made. it has to be the one right after the last one here.
+func (s *Store) Apply(c Change) error {
+	if c.Seq == 0 {
+		return ErrOutOfOrder
+	}
+
+	sh := s.shard(nsKey{c.Namespace, c.Key})
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return s.write(sh, c.record())
+}
+
+// throws away everything and starts over from a Dump of another store.
+// persisted as a snapshot right away, so a crash never leaves half of it behind.
+func (s *Store) Restore(seq uint64, changes []Change) error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	s.lockAll()
+	defer s.unlockAll()
+
+	data := make(map[nsKey]entry, len(changes))
+	for _, c := range changes {
+		data[nsKey{c.Namespace, c.Key}] = entry{
+			value:   c.Value,
+			expires: c.Expires,
+		}
+	}
+
+	if s.log != nil {
+		snap, err := s.rotate()
+		if err != nil {
+			return err
+		}
+		err = writeSnapshot(s.dir, snap, seq, data)
+		if err != nil {
+			return err
+		}
+		s.snapGen = snap
+		s.snapSeq = seq
+		defer s.cleanup(snap)
+	}
+
+	for _, sh := range s.shards {
+		clear(sh.data)
+	}
+	for k, e := range data {
+		s.shard(k).data[k] = e
+	}
+	s.seq = seq
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.close()
+	s.log = nil
+	return err
+}
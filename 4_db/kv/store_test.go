@@ -0,0 +1,493 @@
+package kv_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"protohackers/4_db/kv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVersion(t *testing.T) {
+	s := kv.NewStore("udin 1.0")
+
+	err := s.Insert(kv.VersionKey, "hacked")
+	if !errors.Is(err, kv.ErrReadOnlyKey) {
+		t.Fatalf("wrong error inserting version. expected %v got %v", kv.ErrReadOnlyKey, err)
+	}
+
+	v, _ := s.Get(kv.VersionKey)
+	if v != "udin 1.0" {
+		t.Fatalf("wrong version. expected %q got %q", "udin 1.0", v)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Insert("foo", "bar")
+	s.Insert("snap", "shot")
+	err = s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Insert("foo", "baz")
+	s.Insert("", "empty key")
+	s.Insert("multi=equals", "a=b")
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = kv.Open(dir, "2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	type getCases struct {
+		key   string
+		value string
+		ok    bool
+	}
+
+	cases := []getCases{
+		{"foo", "baz", true},
+		{"snap", "shot", true},
+		{"", "empty key", true},
+		{"multi=equals", "a=b", true},
+		{"nope", "", false},
+		{kv.VersionKey, "2.0", true},
+	}
+
+	for _, c := range cases {
+		v, ok := s.Get(c.key)
+		if v != c.value || ok != c.ok {
+			t.Fatalf("wrong value for %q. expected %q %v got %q %v", c.key, c.value, c.ok, v, ok)
+		}
+	}
+}
+
+func TestTornLog(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Insert("foo", "bar")
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crashed halfway through the next record
+	logs, _ := filepath.Glob(filepath.Join(dir, "log-*.log"))
+	if len(logs) != 1 {
+		t.Fatalf("expected 1 log got %v", logs)
+	}
+	f, err := os.OpenFile(logs[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 3, 0, 0, 0, 3, 'b', 'a'})
+	f.Close()
+
+	s, err = kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := s.Get("foo")
+	if v != "bar" {
+		t.Fatalf("wrong value for foo. expected %q got %q", "bar", v)
+	}
+
+	// the torn record is cut off so new ones don't end up behind it
+	s.Insert("baz", "qux")
+	s.Close()
+
+	s, err = kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	v, _ = s.Get("baz")
+	if v != "qux" {
+		t.Fatalf("wrong value for baz. expected %q got %q", "qux", v)
+	}
+}
+
+// unlike the log, a snapshot is never torn. a bad record in there has to stop the store from opening.
+func TestCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Insert("foo", "bar")
+	s.Insert("baz", "qux")
+	err = s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	snaps, _ := filepath.Glob(filepath.Join(dir, "snapshot-*.snap"))
+	if len(snaps) != 1 {
+		t.Fatalf("expected 1 snapshot got %v", snaps)
+	}
+	b, err := os.ReadFile(snaps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xFF
+	err = os.WriteFile(snaps[0], b, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = kv.Open(dir, "1.0")
+	if err == nil || !strings.Contains(err.Error(), "invalid snapshot") {
+		t.Fatalf("wrong error for a corrupt snapshot. expected an invalid snapshot got %v", err)
+	}
+}
+
+func TestAtomicOps(t *testing.T) {
+	s := kv.NewStore("1.0")
+
+	n, err := s.Incr("hits", 5)
+	if err != nil || n != 5 {
+		t.Fatalf("wrong incr of a missing key. expected 5 got %v %v", n, err)
+	}
+	n, err = s.Incr("hits", -7)
+	if err != nil || n != -2 {
+		t.Fatalf("wrong decr. expected -2 got %v %v", n, err)
+	}
+
+	s.Insert("name", "udin")
+	_, err = s.Incr("name", 1)
+	if !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("wrong error incrementing a string. expected %v got %v", kv.ErrConflict, err)
+	}
+
+	type casCases struct {
+		expected string
+		value    string
+		current  string
+		err      error
+	}
+
+	cases := []casCases{
+		{"budi", "swag", "udin", kv.ErrConflict},
+		{"udin", "swag", "swag", nil},
+		{"udin", "nope", "swag", kv.ErrConflict},
+	}
+
+	for _, c := range cases {
+		current, err := s.CompareAndSwap("name", c.expected, c.value)
+		if current != c.current || !errors.Is(err, c.err) {
+			t.Fatalf("wrong cas %q -> %q. expected %q %v got %q %v", c.expected, c.value, c.current, c.err, current, err)
+		}
+	}
+
+	err = s.Delete("name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Delete("name")
+	if !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("wrong error deleting a missing key. expected %v got %v", kv.ErrConflict, err)
+	}
+	err = s.Delete(kv.VersionKey)
+	if !errors.Is(err, kv.ErrReadOnlyKey) {
+		t.Fatalf("wrong error deleting version. expected %v got %v", kv.ErrReadOnlyKey, err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.InsertTTL("short", "lived", 50*time.Millisecond)
+	s.InsertTTL("long", "lived", time.Hour)
+	s.Insert("gone", "soon")
+	s.Delete("gone")
+
+	_, ok := s.Get("short")
+	if !ok {
+		t.Fatalf("expected short to be there before it expires")
+	}
+	time.Sleep(100 * time.Millisecond)
+	s.Close()
+
+	s, err = kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	type ttlCases struct {
+		key string
+		ok  bool
+	}
+
+	cases := []ttlCases{
+		{"short", false},
+		{"long", true},
+		{"gone", false},
+	}
+
+	for _, c := range cases {
+		_, ok := s.Get(c.key)
+		if ok != c.ok {
+			t.Fatalf("wrong presence of %v. expected %v got %v", c.key, c.ok, ok)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Insert("svc.foo.port", "80")
+	s.Namespace("teamA").Insert("svc.foo.port", "8080")
+	s.Namespace("teamA").Insert("svc.foo.host", "udin")
+	s.Namespace("teamA").Insert("svc.bar.host", "budi")
+	s.Close()
+
+	s, err = kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	v, _ := s.Get("svc.foo.port")
+	if v != "80" {
+		t.Fatalf("wrong value in the default namespace. expected %q got %q", "80", v)
+	}
+
+	type scanCases struct {
+		ns     string
+		prefix string
+		exp    []kv.Pair
+	}
+
+	cases := []scanCases{
+		{"teamA", "svc.foo.", []kv.Pair{{"svc.foo.host", "udin"}, {"svc.foo.port", "8080"}}},
+		{"", "svc.", []kv.Pair{{"svc.foo.port", "80"}}},
+		{"teamB", "svc.", []kv.Pair{}},
+		{"teamB", "ver", []kv.Pair{{kv.VersionKey, "1.0"}}},
+	}
+
+	for _, c := range cases {
+		out := s.Namespace(c.ns).Scan(c.prefix)
+		if !slices.Equal(out, c.exp) {
+			t.Fatalf("wrong scan of %q in %q. expected %v got %v", c.prefix, c.ns, c.exp, out)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	dir := t.TempDir()
+
+	primary, err := kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	live := make([]kv.Change, 0)
+	seq, stop := primary.Follow(func(c kv.Change) {
+		live = append(live, c)
+	})
+	if seq != 0 {
+		t.Fatalf("wrong seq of an empty store. expected 0 got %v", seq)
+	}
+
+	primary.Insert("a", "1")
+	primary.Namespace("teamA").Insert("b", "2")
+	primary.Delete("a")
+	stop()
+	primary.Insert("c", "3")
+
+	if len(live) != 3 || live[2].Seq != 3 || !live[2].Delete {
+		t.Fatalf("wrong followed changes. got %v", live)
+	}
+
+	changes, err := primary.Changes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || changes[0].Seq != 2 || changes[0].Namespace != "teamA" {
+		t.Fatalf("wrong changes after 1. got %v", changes)
+	}
+
+	// replay everything onto a replica
+	replica := kv.NewStore("1.0")
+	changes, _ = primary.Changes(0)
+	for _, c := range changes {
+		err := replica.Apply(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = replica.Apply(changes[0])
+	if !errors.Is(err, kv.ErrOutOfOrder) {
+		t.Fatalf("wrong error applying a change twice. expected %v got %v", kv.ErrOutOfOrder, err)
+	}
+	if replica.Seq() != 4 {
+		t.Fatalf("wrong replica seq. expected 4 got %v", replica.Seq())
+	}
+
+	// older changes are only in the snapshot now
+	primary.Snapshot()
+	_, err = primary.Changes(2)
+	if !errors.Is(err, kv.ErrCompacted) {
+		t.Fatalf("wrong error asking for compacted changes. expected %v got %v", kv.ErrCompacted, err)
+	}
+	primary.Insert("d", "4")
+	changes, err = primary.Changes(4)
+	if err != nil || len(changes) != 1 || changes[0].Seq != 5 {
+		t.Fatalf("wrong changes after the snapshot. got %v %v", changes, err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+
+	primary := kv.NewStore("1.0")
+	primary.Insert("a", "1")
+	primary.Namespace("teamA").Insert("b", "2")
+
+	replica, err := kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica.Insert("stale", "yes")
+
+	seq, dump := primary.Dump()
+	err = replica.Restore(seq, dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica.Close()
+
+	replica, err = kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	if replica.Seq() != 2 {
+		t.Fatalf("wrong seq after restore. expected 2 got %v", replica.Seq())
+	}
+	_, ok := replica.Get("stale")
+	if ok {
+		t.Fatalf("expected stale key to be gone after restore")
+	}
+	v, _ := replica.Namespace("teamA").Get("b")
+	if v != "2" {
+		t.Fatalf("wrong value for b. expected %q got %q", "2", v)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 8
+	const rounds = 200
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				s.Incr("counter", 1)
+				s.Insert(fmt.Sprintf("w%v.%v", w, i), strconv.Itoa(i))
+				s.Get("counter")
+				if i%50 == 0 {
+					s.Scan("w")
+				}
+			}
+		}()
+	}
+	// snapshots in the middle of it all
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 5 {
+			err := s.Snapshot()
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	// one change per call, none lost or doubled
+	expSeq := uint64(workers * rounds * 2)
+	if s.Seq() != expSeq {
+		t.Fatalf("wrong seq. expected %v got %v", expSeq, s.Seq())
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = kv.Open(dir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	v, _ := s.Get("counter")
+	if v != strconv.Itoa(workers*rounds) {
+		t.Fatalf("wrong counter. expected %v got %v", workers*rounds, v)
+	}
+	got := len(s.Scan("w"))
+	if got != workers*rounds {
+		t.Fatalf("wrong number of keys. expected %v got %v", workers*rounds, got)
+	}
+	if s.Seq() != expSeq {
+		t.Fatalf("wrong seq after reopening. expected %v got %v", expSeq, s.Seq())
+	}
+}
+
+func BenchmarkParallel(b *testing.B) {
+	s := kv.NewStore("1.0")
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := strconv.Itoa(i % 1024)
+			if i%4 == 0 {
+				s.Insert(key, "value")
+			} else {
+				s.Get(key)
+			}
+			i++
+		}
+	})
+}
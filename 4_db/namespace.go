@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"protohackers/4_db/kv"
+	"strings"
+)
+
+// Which namespace each client gets, going by its address.
+// Clients that match nothing share the default namespace, which is where keys lived before namespaces.
+type namespaces []nsRule
+
+type nsRule struct {
+	net *net.IPNet
+	ns  string
+}
+
+// one rule per line, "<cidr> <namespace>". the first match wins.
+// blank lines and lines starting with # are skipped.
+// an empty path means no rules, so everyone shares the default namespace.
+func loadNamespaces(path string) (namespaces, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := make(namespaces, 0)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: expected <cidr> <namespace>", path, line)
+		}
+		_, ipnet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %w", path, line, err)
+		}
+		if len(fields[1]) > kv.MaxNamespace {
+			return nil, fmt.Errorf("%v:%v: namespace is too long", path, line)
+		}
+
+		ret = append(ret, nsRule{
+			net: ipnet,
+			ns:  fields[1],
+		})
+	}
+	return ret, sc.Err()
+}
+
+func (n namespaces) lookup(ip net.IP) string {
+	for _, r := range n {
+		if r.net.Contains(ip) {
+			return r.ns
+		}
+	}
+	return ""
+}
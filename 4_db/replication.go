@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"protohackers/4_db/kv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReplica      = fmt.Errorf("replicas are read only, talk to the primary")
+	ErrReplicaSlow  = fmt.Errorf("replica can't keep up")
+	ErrBadHandshake = fmt.Errorf("bad replication handshake")
+	ErrReplicaAuth  = fmt.Errorf("replication authentication failed")
+)
+
+const (
+	// changes queued per replica before we give up on it.
+	// it reconnects and catches up from the log anyway.
+	replicaQueueSize  = 4096
+	replicaMaxBackoff = 30 * time.Second
+	// to get through the challenge, so a silent peer can't hold a connection open
+	replicaHandshakeTimeout = 10 * time.Second
+)
+
+// One gob message on a replication link.
+//
+// The primary starts with a challenge nonce. The replica answers with a hello carrying the last change it has,
+// an HMAC of that nonce with the shared secret, and a nonce of its own for the primary to answer with an auth.
+// Nothing gets streamed until both sides proved they know the secret.
+// The primary answers with every change after that, read back from its log,
+// then keeps streaming changes as they happen.
+// If the log doesn't go back far enough any more it sends a reset with everything it has instead.
+//
+// The replica acks every change it applies, and sends inserts it got from clients if it forwards them.
+// Forwarded inserts carry the client's address and the primary picks the namespace with its own rules,
+// so a replica can't write to a namespace the client couldn't have.
+type replMsg struct {
+	Type    string // hello, ack or insert from the replica. challenge, auth, change or reset from the primary.
+	Seq     uint64
+	Nonce   string      // challenge and hello
+	Mac     string      // hello and auth
+	Change  kv.Change   // change, and insert which only has the key and value
+	Client  net.IP      // insert
+	Changes []kv.Change // reset
+}
+
+// proves we know the secret, for the nonce the other side sent.
+// the role goes in too, so a hello can't be played back as an auth.
+func replMac(secret string, nonce string, role string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(nonce + " " + role))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func makeNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// Streams every change to whoever follows this server.
+type primary struct {
+	s      *server
+	secret string
+	acked  map[string]uint64 // last change each connected replica acked, by address
+	mu     sync.Mutex
+}
+
+func makePrimary(s *server, secret string) *primary {
+	return &primary{
+		s:      s,
+		secret: secret,
+		acked:  make(map[string]uint64),
+	}
+}
+
+// accepts replicas until the listener is closed
+func (p *primary) serve(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			err := p.handleReplica(c)
+			log.Printf("replica %v gone: %v", c.RemoteAddr(), err)
+		}()
+	}
+}
+
+// last change the replica at addr acked
+func (p *primary) ackedBy(addr string) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.acked[addr]
+}
+
+func (p *primary) handleReplica(c net.Conn) error {
+	defer c.Close()
+
+	enc := gob.NewEncoder(c)
+	dec := gob.NewDecoder(c)
+
+	c.SetDeadline(time.Now().Add(replicaHandshakeTimeout))
+	nonce := makeNonce()
+	err := enc.Encode(replMsg{
+		Type:  "challenge",
+		Nonce: nonce,
+	})
+	if err != nil {
+		return err
+	}
+
+	var hello replMsg
+	err = dec.Decode(&hello)
+	if err != nil {
+		return err
+	}
+	if hello.Type != "hello" {
+		return ErrBadHandshake
+	}
+	if !hmac.Equal([]byte(hello.Mac), []byte(replMac(p.secret, nonce, "replica"))) {
+		return ErrReplicaAuth
+	}
+	err = enc.Encode(replMsg{
+		Type: "auth",
+		Mac:  replMac(p.secret, hello.Nonce, "primary"),
+	})
+	if err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	log.Printf("replica %v connected at %v", c.RemoteAddr(), hello.Seq)
+
+	addr := c.RemoteAddr().String()
+	defer func() {
+		p.mu.Lock()
+		delete(p.acked, addr)
+		p.mu.Unlock()
+	}()
+
+	// start following before catching up, so nothing falls in between.
+	// whatever shows up twice gets skipped.
+	live := make(chan kv.Change, replicaQueueSize)
+	slow := make(chan struct{})
+	var slowOnce sync.Once
+	at, stop := p.s.store.Follow(func(ch kv.Change) {
+		select {
+		case live <- ch:
+		default:
+			slowOnce.Do(func() {
+				close(slow)
+			})
+		}
+	})
+	defer stop()
+
+	// acks and forwarded inserts
+	done := make(chan error, 1)
+	go func() {
+		done <- p.readReplica(addr, dec)
+	}()
+
+	sent := hello.Seq
+	changes, err := p.s.store.Changes(hello.Seq)
+	if errors.Is(err, kv.ErrCompacted) || hello.Seq > at {
+		// too far behind, or ahead of us which means it followed someone else
+		seq, dump := p.s.store.Dump()
+		err = enc.Encode(replMsg{
+			Type:    "reset",
+			Seq:     seq,
+			Changes: dump,
+		})
+		sent = seq
+	} else if err == nil {
+		for _, ch := range changes {
+			err = enc.Encode(replMsg{
+				Type:   "change",
+				Change: ch,
+			})
+			if err != nil {
+				break
+			}
+			sent = ch.Seq
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case ch := <-live:
+			if ch.Seq <= sent {
+				continue
+			}
+			err := enc.Encode(replMsg{
+				Type:   "change",
+				Change: ch,
+			})
+			if err != nil {
+				return err
+			}
+			sent = ch.Seq
+		case <-slow:
+			return ErrReplicaSlow
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+func (p *primary) readReplica(addr string, dec *gob.Decoder) error {
+	for {
+		var msg replMsg
+		err := dec.Decode(&msg)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case "ack":
+			p.mu.Lock()
+			p.acked[addr] = msg.Seq
+			p.mu.Unlock()
+		case "insert":
+			if msg.Client == nil {
+				continue
+			}
+			p.s.insert(p.s.rules.lookup(msg.Client), msg.Change.Key, msg.Change.Value)
+		}
+	}
+}
+
+// Follows a primary, applying whatever it streams.
+type replica struct {
+	store   *kv.Store
+	primary string
+	secret  string
+	// send client inserts to the primary instead of dropping them
+	forward bool
+
+	out chan replMsg // only while connected
+	mu  sync.Mutex
+}
+
+func makeReplica(store *kv.Store, primary string, secret string, forward bool) *replica {
+	return &replica{
+		store:   store,
+		primary: primary,
+		secret:  secret,
+		forward: forward,
+	}
+}
+
+// keeps following the primary, reconnecting with backoff whenever the link drops.
+// returns once the context is done.
+func (r *replica) run(ctx context.Context) {
+	backoff := 100 * time.Millisecond
+	for {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", r.primary)
+		if err == nil {
+			stop := context.AfterFunc(ctx, func() {
+				c.Close()
+			})
+			start := time.Now()
+			err = r.follow(c)
+			stop()
+			// it was up for a while, so start the backoff over
+			if time.Since(start) > replicaMaxBackoff {
+				backoff = 100 * time.Millisecond
+			}
+		}
+		log.Printf("following %v: %v. retrying in %v", r.primary, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, replicaMaxBackoff)
+	}
+}
+
+func (r *replica) follow(c net.Conn) error {
+	defer c.Close()
+
+	enc := gob.NewEncoder(c)
+	dec := gob.NewDecoder(c)
+
+	err := r.handshake(c, enc, dec)
+	if err != nil {
+		return err
+	}
+
+	// gob encoders aren't safe to share, so one goroutine does all the writing
+	out := make(chan replMsg, replicaQueueSize)
+	r.mu.Lock()
+	r.out = out
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.out = nil
+		r.mu.Unlock()
+	}()
+
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case msg := <-out:
+				err := enc.Encode(msg)
+				if err != nil {
+					c.Close()
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for {
+		var msg replMsg
+		err := dec.Decode(&msg)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case "reset":
+			err = r.store.Restore(msg.Seq, msg.Changes)
+			log.Printf("reset to %v from %v", msg.Seq, r.primary)
+		case "change":
+			err = r.store.Apply(msg.Change)
+		}
+		if err != nil {
+			// reconnecting sorts it out
+			return err
+		}
+
+		r.send(replMsg{
+			Type: "ack",
+			Seq:  r.store.Seq(),
+		})
+	}
+}
+
+// proves to the primary we know the secret and makes it prove the same, then says where we're at
+func (r *replica) handshake(c net.Conn, enc *gob.Encoder, dec *gob.Decoder) error {
+	c.SetDeadline(time.Now().Add(replicaHandshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	var challenge replMsg
+	err := dec.Decode(&challenge)
+	if err != nil {
+		return err
+	}
+	if challenge.Type != "challenge" {
+		return ErrBadHandshake
+	}
+
+	nonce := makeNonce()
+	err = enc.Encode(replMsg{
+		Type:  "hello",
+		Seq:   r.store.Seq(),
+		Nonce: nonce,
+		Mac:   replMac(r.secret, challenge.Nonce, "replica"),
+	})
+	if err != nil {
+		return err
+	}
+
+	var auth replMsg
+	err = dec.Decode(&auth)
+	if err != nil {
+		return err
+	}
+	if auth.Type != "auth" || !hmac.Equal([]byte(auth.Mac), []byte(replMac(r.secret, nonce, "primary"))) {
+		return ErrReplicaAuth
+	}
+	return nil
+}
+
+// forwards the insert from client to the primary, or drops it
+func (r *replica) insert(client net.IP, key string, value string) {
+	if !r.forward {
+		log.Printf("dropping ins for %q: %v", key, ErrReplica)
+		return
+	}
+
+	ok := r.send(replMsg{
+		Type: "insert",
+		Change: kv.Change{
+			Key:   key,
+			Value: value,
+		},
+		Client: client,
+	})
+	if !ok {
+		log.Printf("dropping ins for %q, not connected to %v", key, r.primary)
+	}
+}
+
+// false if there is no link, or it is backed up
+func (r *replica) send(msg replMsg) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.out == nil {
+		return false
+	}
+	select {
+	case r.out <- msg:
+		return true
+	default:
+		return false
+	}
+}
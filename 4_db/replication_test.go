@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"protohackers/4_db/kv"
+	"testing"
+	"time"
+)
+
+// a server on loopback, with a client already pointed at it
+func startServer(t *testing.T, store *kv.Store, r *replica) (*server, *net.UDPConn) {
+	t.Helper()
+
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	s := &server{
+		store:   store,
+		replica: r,
+		c:       c,
+	}
+	go s.serve()
+
+	cl, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cl.Close() })
+	return s, cl
+}
+
+// retrieves key until it has the expected value
+func waitFor(t *testing.T, cl *net.UDPConn, key string, exp string) {
+	t.Helper()
+
+	b := make([]byte, maxDatagram)
+	var got string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		cl.Write([]byte(key))
+		cl.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err := cl.Read(b)
+		if err == nil {
+			got = string(b[:n])
+			if got == key+"="+exp {
+				return
+			}
+		}
+	}
+	t.Fatalf("wrong value for %q. expected %q got %q", key, key+"="+exp, got)
+}
+
+func TestReplication(t *testing.T) {
+	pstore, err := kv.Open(t.TempDir(), "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pstore.Close()
+	ps, pcl := startServer(t, pstore, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	p := makePrimary(ps, "hunter2")
+	go p.serve(ln)
+
+	// this one comes in through the log on connect
+	pcl.Write([]byte("before=1"))
+	waitFor(t, pcl, "before", "1")
+
+	rdir := t.TempDir()
+	rstore, err := kv.Open(rdir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := makeReplica(rstore, ln.Addr().String(), "hunter2", true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(done)
+	}()
+	_, rcl := startServer(t, rstore, r)
+
+	waitFor(t, rcl, "before", "1")
+
+	// streamed live
+	pcl.Write([]byte("live=2"))
+	waitFor(t, rcl, "live", "2")
+
+	// forwarded to the primary and back
+	rcl.Write([]byte("fwd=3"))
+	waitFor(t, pcl, "fwd", "3")
+	waitFor(t, rcl, "fwd", "3")
+
+	// the version never changes, on either side
+	waitFor(t, rcl, kv.VersionKey, "1.0")
+
+	// only one replica, so whatever address it acked from
+	acked := func() uint64 {
+		p.mu.Lock()
+		addrs := make([]string, 0)
+		for addr := range p.acked {
+			addrs = append(addrs, addr)
+		}
+		p.mu.Unlock()
+		if len(addrs) == 0 {
+			return 0
+		}
+		return p.ackedBy(addrs[0])
+	}
+	for deadline := time.Now().Add(5 * time.Second); acked() < pstore.Seq(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong acked seq. expected %v got %v", pstore.Seq(), acked())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// take the replica down, move on without it and compact the log away
+	cancel()
+	<-done
+	rstore.Close()
+
+	// gone replicas don't keep an ack around
+	for deadline := time.Now().Add(5 * time.Second); acked() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong acked seq after disconnect. expected 0 got %v", acked())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pcl.Write([]byte("while-down=4"))
+	waitFor(t, pcl, "while-down", "4")
+	err = pstore.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcl.Write([]byte("after-snapshot=5"))
+	waitFor(t, pcl, "after-snapshot", "5")
+
+	rstore, err = kv.Open(rdir, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rstore.Close()
+	r = makeReplica(rstore, ln.Addr().String(), "hunter2", false)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go r.run(ctx)
+	_, rcl = startServer(t, rstore, r)
+
+	waitFor(t, rcl, "fwd", "3")
+	waitFor(t, rcl, "while-down", "4")
+	waitFor(t, rcl, "after-snapshot", "5")
+
+	// this one doesn't forward
+	rcl.Write([]byte("dropped=6"))
+	pcl.Write([]byte("marker=7"))
+	waitFor(t, rcl, "marker", "7")
+	waitFor(t, pcl, "dropped", "")
+}
+
+func TestReplicationBadSecret(t *testing.T) {
+	ps, _ := startServer(t, kv.NewStore("1.0"), nil)
+	p := makePrimary(ps, "hunter2")
+	r := makeReplica(kv.NewStore("1.0"), "primary", "letmein", true)
+
+	// whoever checks first hangs up on the other, so each side gets checked on its own
+	a, b := net.Pipe()
+	go r.follow(b)
+	err := p.handleReplica(a)
+	if !errors.Is(err, ErrReplicaAuth) {
+		t.Fatalf("wrong primary error. expected %v got %v", ErrReplicaAuth, err)
+	}
+
+	// and a primary with another secret gets turned away by the replica
+	a, b = net.Pipe()
+	go func() {
+		defer a.Close()
+		enc := gob.NewEncoder(a)
+		dec := gob.NewDecoder(a)
+		enc.Encode(replMsg{Type: "challenge", Nonce: "x"})
+		var hello replMsg
+		dec.Decode(&hello)
+		enc.Encode(replMsg{Type: "auth", Mac: replMac("hunter2", hello.Nonce, "primary")})
+	}()
+	err = r.follow(b)
+	if !errors.Is(err, ErrReplicaAuth) {
+		t.Fatalf("wrong replica error. expected %v got %v", ErrReplicaAuth, err)
+	}
+}
+
+// the primary picks the namespace from the client's address, whatever the replica says
+func TestReplicationNamespaces(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/8")
+	store := kv.NewStore("1.0")
+	ps, _ := startServer(t, store, nil)
+	ps.rules = namespaces{{net: ipnet, ns: "teamA"}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go makePrimary(ps, "hunter2").serve(ln)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	enc := gob.NewEncoder(c)
+	dec := gob.NewDecoder(c)
+	r := makeReplica(kv.NewStore("1.0"), ln.Addr().String(), "hunter2", true)
+	err = r.handshake(c, enc, dec)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	enc.Encode(replMsg{
+		Type:   "insert",
+		Change: kv.Change{Namespace: "teamB", Key: "foo", Value: "bar"},
+		Client: net.ParseIP("10.1.2.3"),
+	})
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if v, _ := store.Namespace("teamA").Get("foo"); v == "bar" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("forwarded insert never made it to teamA")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, ok := store.Namespace("teamB").Get("foo"); ok {
+		t.Fatalf("wrong value in teamB. expected nothing got %q", v)
+	}
+}
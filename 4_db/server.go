@@ -0,0 +1,221 @@
+package main
+
+import (
+	"hash/maphash"
+	"log"
+	"net"
+	"protohackers/4_db/kv"
+	"strings"
+	"sync"
+)
+
+type server struct {
+	store    *kv.Store
+	rules    namespaces
+	extended bool
+	watches  *watcher // only used with extended
+	replica  *replica // set if this is a replica. they only answer reads.
+	workers  int      // goroutines handling requests. at least one.
+	verbose  bool     // log every request
+	c        *net.UDPConn
+}
+
+// datagrams waiting per worker before the read loop waits too
+const workerQueueSize = 256
+
+// notifications waiting to go out before new ones get dropped
+const notifyQueueSize = 1024
+
+var buffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, maxDatagram)
+		return &b
+	},
+}
+
+type datagram struct {
+	b    *[]byte // from buffers
+	n    int
+	addr *net.UDPAddr
+}
+
+// reads datagrams and hands them to the workers.
+//
+// every client address always lands on the same worker, and each worker goes through its queue in order.
+// so an insert followed by a retrieve from the same client always sees the insert,
+// as long as the network didn't reorder them on the way.
+func (s *server) serve() error {
+	queues := make([]chan datagram, max(s.workers, 1))
+	for i := range queues {
+		queues[i] = make(chan datagram, workerQueueSize)
+		go s.work(queues[i])
+	}
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+	}()
+	if s.watches != nil {
+		defer s.notifyWatchers()()
+	}
+
+	seed := maphash.MakeSeed()
+	for {
+		b := buffers.Get().(*[]byte)
+		n, addr, err := s.c.ReadFromUDP(*b)
+		if err != nil {
+			buffers.Put(b)
+			return err
+		}
+
+		// a full buffer means the packet was at least this big, maybe bigger and cut off.
+		// either way it's over the limit.
+		if n >= maxDatagram {
+			buffers.Put(b)
+			log.Println("dropping oversize packet from", addr)
+			continue
+		}
+
+		var h maphash.Hash
+		h.SetSeed(seed)
+		h.Write(addr.IP)
+		h.WriteByte(byte(addr.Port >> 8))
+		h.WriteByte(byte(addr.Port))
+		queues[h.Sum64()%uint64(len(queues))] <- datagram{b, n, addr}
+	}
+}
+
+func (s *server) work(q chan datagram) {
+	for d := range q {
+		// only what was actually sent.
+		// anything can be in there, NULs included.
+		req := string((*d.b)[:d.n])
+		buffers.Put(d.b)
+
+		s.logf("recv from: %v", d.addr)
+		s.handle(req, d.addr)
+	}
+}
+
+// for the chatty per request logs, which slow everything down under load
+func (s *server) logf(format string, v ...any) {
+	if s.verbose {
+		log.Printf(format, v...)
+	}
+}
+
+func (s *server) handle(req string, addr *net.UDPAddr) {
+	ns := s.rules.lookup(addr.IP)
+	m := s.store.Namespace(ns)
+
+	if s.extended && strings.HasPrefix(req, extendedPrefix) {
+		s.handleExtended(req, ns, addr)
+		return
+	}
+
+	ins, ret := ParseRequest(req)
+
+	if ins != nil {
+		if s.replica != nil {
+			s.replica.insert(addr.IP, ins.Key, ins.Value)
+		} else {
+			s.insert(ns, ins.Key, ins.Value)
+		}
+	}
+
+	if ret != nil {
+		value, _ := m.Get(ret.Key)
+		retval, err := makeResponse(ret.Key, value)
+		if err != nil {
+			log.Printf("not answering ret for %q: %v", ret.Key, err)
+			return
+		}
+
+		s.send(retval, addr)
+		s.logf("ret for %q: %q", ret.Key, value)
+	}
+}
+
+func (s *server) insert(ns string, key string, value string) {
+	err := s.store.Namespace(ns).Insert(key, value)
+	if err != nil {
+		log.Printf("ins for %q failed: %v", key, err)
+		return
+	}
+	s.logf("ins for %q: %q", key, value)
+}
+
+func (s *server) handleExtended(req string, ns string, addr *net.UDPAddr) {
+	m := s.store.Namespace(ns)
+
+	cmd, err := ParseExtended(req)
+	if err != nil {
+		s.send(extendedReply("error", err.Error()), addr)
+		return
+	}
+	if s.replica != nil && cmd.Op != "scan" {
+		s.send(extendedReply("error", ErrReplica.Error()), addr)
+		return
+	}
+
+	switch cmd.Op {
+	case "scan":
+		replies := scanReplies(m.Scan(cmd.Key))
+		s.logf("scan for %q: %v datagrams", cmd.Key, len(replies))
+		for _, reply := range replies {
+			s.send(reply, addr)
+		}
+
+	case "watch", "confirm", "unwatch":
+		reply := s.watches.handle(cmd, ns, addr)
+		s.logf("%v for %q from %v: %q", cmd.Op, cmd.Key, addr, reply)
+		s.send(reply, addr)
+
+	default:
+		reply := execute(m, cmd)
+		s.logf("%v for %q: %q", cmd.Op, cmd.Key, reply)
+		s.send(reply, addr)
+	}
+}
+
+// pushes every change to whoever is watching the key, until stop is called.
+//
+// the store calls back in seq order with the key still locked,
+// so two writes to the same key can't get their notifications the wrong way round.
+// sending can block, so that happens on its own goroutine. if it falls behind notifications get dropped,
+// the watcher sees the gap in seq.
+func (s *server) notifyWatchers() (stop func()) {
+	queue := make(chan notification, notifyQueueSize)
+	_, unfollow := s.store.Follow(func(ch kv.Change) {
+		if ch.Key == kv.VersionKey {
+			return
+		}
+		for _, n := range s.watches.notify(ch.Namespace, ch.Key, ch.Value, ch.Delete) {
+			select {
+			case queue <- n:
+			default:
+			}
+		}
+	})
+
+	go func() {
+		for n := range queue {
+			s.send(n.payload, n.addr)
+		}
+	}()
+
+	return func() {
+		// nothing gets queued once we stop following
+		unfollow()
+		close(queue)
+	}
+}
+
+// drops anything that doesn't fit in a datagram
+func (s *server) send(b []byte, addr *net.UDPAddr) {
+	if len(b) >= maxDatagram {
+		log.Println("not answering, reply is too big")
+		return
+	}
+	s.c.WriteToUDP(b, addr)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"protohackers/4_db/kv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientOrdering(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := &server{
+		store:   kv.NewStore("1.0"),
+		workers: 4,
+		c:       c,
+	}
+	go s.serve()
+
+	const clients = 8
+	const rounds = 100
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		cl, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+		cl.SetDeadline(time.Now().Add(5 * time.Second))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// every client hammers its own key, never waiting between the insert and the retrieve
+			key := fmt.Sprintf("client%v", i)
+			b := make([]byte, maxDatagram)
+			for j := range rounds {
+				exp := fmt.Sprintf("%v=%v", key, j)
+				cl.Write([]byte(exp))
+				cl.Write([]byte(key))
+
+				n, err := cl.Read(b)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if string(b[:n]) != exp {
+					t.Errorf("wrong value. expected %q got %q", exp, b[:n])
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManyWatchers   = fmt.Errorf("too many watchers on that key")
+	ErrTooManyWatches    = fmt.Errorf("too many watches from this client")
+	ErrTooManyChallenges = fmt.Errorf("too many watches waiting to be confirmed")
+	ErrUnknownToken      = fmt.Errorf("unknown or expired token")
+)
+
+const (
+	// how long a client has to confirm a new watch. sweep should run at least this often
+	watchChallengeTimeout = 10 * time.Second
+	// unconfirmed watches across every client, so spoofing lots of addresses can't eat all the memory
+	maxChallenges = 1 << 16
+)
+
+// Pushes changes to clients watching a key or a prefix.
+//
+// UDP source addresses are easy to spoof, so a new watch doesn't count until the client proves it gets our replies.
+// The first watch is answered with
+//
+//	\x01challenge\x00token
+//
+// and the client has to send back \x01confirm\x00token from the same address within watchChallengeTimeout.
+// Only then is the watch on, and it gets the usual \x01ok\x00lease reply.
+// Each client IP can only have perClient watches and challenges going at once.
+//
+// Watches are leased. Sending the same watch again renews it, with whatever lease is asked for,
+// up to maxLease. Once the lease runs out the watch is gone.
+//
+// Each change the watch sees is pushed as
+//
+//	\x01notify\x00seq\x00key=value
+//
+// or just the key without "=value" if it got deleted. seq counts up from 1 per watch,
+// so a jump means some notifications got lost and it's time to re-read.
+// Delivery is best effort, nothing gets resent.
+type watcher struct {
+	subs      map[watchKey]map[string]*subscription // by client address
+	pending   map[string]*challenge                 // by token
+	clients   map[string]int                        // subscriptions and challenges per client ip
+	limit     int                                   // subscriptions per watchKey
+	perClient int
+	maxLease  time.Duration
+	mu        sync.Mutex
+	now       func() time.Time
+}
+
+type watchKey struct {
+	ns      string
+	prefix  bool
+	pattern string
+}
+
+type subscription struct {
+	addr    *net.UDPAddr
+	expires time.Time
+	seq     uint64
+}
+
+// a watch waiting to be confirmed
+type challenge struct {
+	key     watchKey
+	addr    *net.UDPAddr
+	lease   time.Duration
+	expires time.Time
+}
+
+type notification struct {
+	addr    *net.UDPAddr
+	payload []byte
+}
+
+func makeWatcher(limit int, perClient int, maxLease time.Duration) *watcher {
+	return &watcher{
+		subs:      make(map[watchKey]map[string]*subscription),
+		pending:   make(map[string]*challenge),
+		clients:   make(map[string]int),
+		limit:     limit,
+		perClient: perClient,
+		maxLease:  maxLease,
+		now:       time.Now,
+	}
+}
+
+// replies to a watch, confirm or unwatch
+func (w *watcher) handle(cmd *Command, ns string, addr *net.UDPAddr) []byte {
+	key := watchKey{
+		ns:      ns,
+		prefix:  cmd.Prefix,
+		pattern: cmd.Key,
+	}
+
+	var lease time.Duration
+	var err error
+	switch cmd.Op {
+	case "unwatch":
+		w.unsubscribe(key, addr)
+		return extendedReply("ok", "")
+
+	case "confirm":
+		lease, err = w.confirm(cmd.Key, addr)
+
+	default:
+		var token string
+		lease, token, err = w.watch(key, addr, cmd.Lease)
+		if err == nil && token != "" {
+			return extendedReply("challenge", token)
+		}
+	}
+
+	if err != nil {
+		return extendedReply("conflict", err.Error())
+	}
+	return extendedReply("ok", strconv.Itoa(int(lease.Seconds())))
+}
+
+// renews the watch if it's already on, otherwise returns the token it has to be confirmed with
+func (w *watcher) watch(key watchKey, addr *net.UDPAddr, lease time.Duration) (time.Duration, string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	sub := w.subs[key][addr.String()]
+	if sub != nil && now.Before(sub.expires) {
+		lease = min(lease, w.maxLease)
+		sub.expires = now.Add(lease)
+		return lease, "", nil
+	}
+
+	// asking again before confirming just gets another token, the old one runs out on its own
+	ip := addr.IP.String()
+	if w.clients[ip] >= w.perClient {
+		return 0, "", ErrTooManyWatches
+	}
+	if len(w.pending) >= maxChallenges {
+		return 0, "", ErrTooManyChallenges
+	}
+	token := makeNonce()
+	w.pending[token] = &challenge{
+		key:     key,
+		addr:    addr,
+		lease:   lease,
+		expires: now.Add(watchChallengeTimeout),
+	}
+	w.clients[ip]++
+	return 0, token, nil
+}
+
+// turns the challenge into a watch, if it's answered from the address it was sent to
+func (w *watcher) confirm(token string, addr *net.UDPAddr) (time.Duration, error) {
+	w.mu.Lock()
+	ch := w.pending[token]
+	if ch == nil || ch.addr.String() != addr.String() || !w.now().Before(ch.expires) {
+		w.mu.Unlock()
+		return 0, ErrUnknownToken
+	}
+	delete(w.pending, token)
+	w.release(ch.addr)
+	w.mu.Unlock()
+
+	return w.subscribe(ch.key, addr, ch.lease)
+}
+
+// returns the lease actually granted
+func (w *watcher) subscribe(key watchKey, addr *net.UDPAddr, lease time.Duration) (time.Duration, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lease = min(lease, w.maxLease)
+	now := w.now()
+
+	subs := w.subs[key]
+	if subs == nil {
+		subs = make(map[string]*subscription)
+		w.subs[key] = subs
+	}
+	w.prune(subs, now)
+
+	sub := subs[addr.String()]
+	if sub == nil {
+		if len(subs) >= w.limit {
+			return 0, ErrTooManyWatchers
+		}
+		if w.clients[addr.IP.String()] >= w.perClient {
+			return 0, ErrTooManyWatches
+		}
+		sub = &subscription{
+			addr: addr,
+		}
+		subs[addr.String()] = sub
+		w.clients[addr.IP.String()]++
+	}
+	sub.expires = now.Add(lease)
+	return lease, nil
+}
+
+func (w *watcher) unsubscribe(key watchKey, addr *net.UDPAddr) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	subs := w.subs[key]
+	if subs[addr.String()] != nil {
+		delete(subs, addr.String())
+		w.release(addr)
+	}
+	if len(subs) == 0 {
+		delete(w.subs, key)
+	}
+}
+
+// what to push to whom now that the key changed
+func (w *watcher) notify(ns string, key string, value string, deleted bool) []notification {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	line := key
+	if !deleted {
+		line += "=" + value
+	}
+
+	now := w.now()
+	ret := make([]notification, 0)
+	for wk, subs := range w.subs {
+		if wk.ns != ns || !wk.matches(key) {
+			continue
+		}
+
+		w.prune(subs, now)
+		if len(subs) == 0 {
+			delete(w.subs, wk)
+			continue
+		}
+
+		for _, sub := range subs {
+			sub.seq++
+			ret = append(ret, notification{
+				addr:    sub.addr,
+				payload: []byte(fmt.Sprintf("%vnotify\x00%v\x00%v", extendedPrefix, sub.seq, line)),
+			})
+		}
+	}
+	return ret
+}
+
+func (wk watchKey) matches(key string) bool {
+	if wk.prefix {
+		return strings.HasPrefix(key, wk.pattern)
+	}
+	return key == wk.pattern
+}
+
+// forgets every expired subscription and challenge. expired challenges still count against their client until then.
+// the ones on keys that keep changing get dropped by notify anyway, this is for the quiet ones.
+func (w *watcher) sweep() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	for wk, subs := range w.subs {
+		w.prune(subs, now)
+		if len(subs) == 0 {
+			delete(w.subs, wk)
+		}
+	}
+	w.prunePending(now)
+}
+
+// drops expired subscriptions
+func (w *watcher) prune(subs map[string]*subscription, now time.Time) {
+	for addr, sub := range subs {
+		if !now.Before(sub.expires) {
+			delete(subs, addr)
+			w.release(sub.addr)
+		}
+	}
+}
+
+// drops challenges nobody answered in time
+func (w *watcher) prunePending(now time.Time) {
+	for token, ch := range w.pending {
+		if !now.Before(ch.expires) {
+			delete(w.pending, token)
+			w.release(ch.addr)
+		}
+	}
+}
+
+// gives a watch or challenge back to the client's count
+func (w *watcher) release(addr *net.UDPAddr) {
+	ip := addr.IP.String()
+	w.clients[ip]--
+	if w.clients[ip] <= 0 {
+		delete(w.clients, ip)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"protohackers/4_db/kv"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchLeases(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := makeWatcher(2, 16, time.Minute)
+	w.now = func() time.Time { return now }
+
+	alice := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	bob := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	carol := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3}
+	foo := watchKey{pattern: "foo"}
+	svc := watchKey{prefix: true, pattern: "svc."}
+
+	lease, _ := w.subscribe(foo, alice, time.Hour)
+	if lease != time.Minute {
+		t.Fatalf("wrong lease. expected %v got %v", time.Minute, lease)
+	}
+	w.subscribe(foo, bob, 10*time.Second)
+	_, err := w.subscribe(foo, carol, time.Minute)
+	if !errors.Is(err, ErrTooManyWatchers) {
+		t.Fatalf("wrong error over the limit. expected %v got %v", ErrTooManyWatchers, err)
+	}
+	w.subscribe(svc, carol, time.Minute)
+
+	type notifyCases struct {
+		after   time.Duration
+		key     string
+		deleted bool
+		exp     map[int]string // by port
+	}
+
+	cases := []notifyCases{
+		{0, "foo", false, map[int]string{1: "\x01notify\x001\x00foo=v", 2: "\x01notify\x001\x00foo=v"}},
+		{0, "svc.a", false, map[int]string{3: "\x01notify\x001\x00svc.a=v"}},
+		{0, "svc.a", true, map[int]string{3: "\x01notify\x002\x00svc.a"}},
+		{0, "bar", false, map[int]string{}},
+		// bob's lease ran out
+		{20 * time.Second, "foo", false, map[int]string{1: "\x01notify\x002\x00foo=v"}},
+	}
+
+	for i, c := range cases {
+		now = now.Add(c.after)
+		out := w.notify("", c.key, "v", c.deleted)
+		if len(out) != len(c.exp) {
+			t.Fatalf("wrong number of notifications for case %v. expected %v got %v", i, len(c.exp), len(out))
+		}
+		for _, n := range out {
+			if string(n.payload) != c.exp[n.addr.Port] {
+				t.Fatalf("wrong notification for case %v to %v. expected %q got %q", i, n.addr.Port, c.exp[n.addr.Port], n.payload)
+			}
+		}
+	}
+
+	// bob's slot is free again
+	_, err = w.subscribe(foo, carol, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other namespaces don't see it
+	out := w.notify("teamA", "foo", "v", false)
+	if len(out) != 0 {
+		t.Fatalf("expected no notifications in another namespace got %v", len(out))
+	}
+}
+
+// a watch sent from someone else's address must never make us send them anything
+func TestWatchChallenge(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := makeWatcher(16, 2, time.Minute)
+	w.now = func() time.Time { return now }
+
+	victim := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1}
+	watch := func(key string) []byte {
+		return w.handle(&Command{Op: "watch", Key: key, Lease: time.Minute}, "", victim)
+	}
+	confirm := func(reply []byte, addr *net.UDPAddr) string {
+		token, _ := strings.CutPrefix(string(reply), "\x01challenge\x00")
+		return string(w.handle(&Command{Op: "confirm", Key: token}, "", addr))
+	}
+
+	foo := watch("foo")
+	if !strings.HasPrefix(string(foo), "\x01challenge\x00") {
+		t.Fatalf("expected a challenge got %q", foo)
+	}
+	if len(w.notify("", "foo", "v", false)) != 0 {
+		t.Fatalf("expected no notifications before the watch is confirmed")
+	}
+	// the challenge only works from where it was sent
+	reply := confirm(foo, other)
+	if reply != "\x01conflict\x00"+ErrUnknownToken.Error() {
+		t.Fatalf("wrong reply confirming from another address. expected %q got %q", ErrUnknownToken, reply)
+	}
+
+	// challenges count against the client too
+	bar := watch("bar")
+	reply = string(watch("baz"))
+	if reply != "\x01conflict\x00"+ErrTooManyWatches.Error() {
+		t.Fatalf("wrong reply over the per client limit. expected %q got %q", ErrTooManyWatches, reply)
+	}
+
+	reply = confirm(foo, victim)
+	if reply != "\x01ok\x0060" {
+		t.Fatalf("wrong reply confirming. expected %q got %q", "\x01ok\x0060", reply)
+	}
+	if len(w.notify("", "foo", "v", false)) != 1 {
+		t.Fatalf("expected a notification once the watch is confirmed")
+	}
+
+	// bar's challenge ran out, which frees its slot
+	now = now.Add(watchChallengeTimeout)
+	reply = confirm(bar, victim)
+	if reply != "\x01conflict\x00"+ErrUnknownToken.Error() {
+		t.Fatalf("wrong reply confirming too late. expected %q got %q", ErrUnknownToken, reply)
+	}
+	w.sweep()
+	baz := watch("baz")
+	if !strings.HasPrefix(string(baz), "\x01challenge\x00") {
+		t.Fatalf("expected a challenge once the old one expired got %q", baz)
+	}
+}
+
+func TestWatchLoopback(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := &server{
+		store:    kv.NewStore("1.0"),
+		extended: true,
+		watches:  makeWatcher(16, 16, time.Minute),
+		c:        c,
+	}
+	go s.serve()
+
+	dial := func() *net.UDPConn {
+		t.Helper()
+		cl, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl.SetDeadline(time.Now().Add(5 * time.Second))
+		return cl
+	}
+	expect := func(cl *net.UDPConn, want string) {
+		t.Helper()
+		b := make([]byte, maxDatagram)
+		n, err := cl.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != want {
+			t.Fatalf("wrong datagram. expected %q got %q", want, b[:n])
+		}
+	}
+
+	watcher := dial()
+	defer watcher.Close()
+	writer := dial()
+	defer writer.Close()
+
+	watcher.Write([]byte("\x01watch\x00prefix\x0030\x00svc.foo."))
+	b := make([]byte, maxDatagram)
+	n, _ := watcher.Read(b)
+	token, ok := strings.CutPrefix(string(b[:n]), "\x01challenge\x00")
+	if !ok {
+		t.Fatalf("expected a challenge got %q", b[:n])
+	}
+	// nothing gets pushed before the watch is confirmed
+	writer.Write([]byte("svc.foo.host=a"))
+	watcher.Write([]byte("\x01confirm\x00" + token))
+	expect(watcher, "\x01ok\x0030")
+	// renewing doesn't need another challenge
+	watcher.Write([]byte("\x01watch\x00prefix\x0030\x00svc.foo."))
+	expect(watcher, "\x01ok\x0030")
+
+	writer.Write([]byte("svc.foo.port=8080"))
+	expect(watcher, "\x01notify\x001\x00svc.foo.port=8080")
+
+	writer.Write([]byte("\x01del\x00svc.foo.port"))
+	expect(writer, "\x01ok")
+	expect(watcher, "\x01notify\x002\x00svc.foo.port")
+
+	watcher.Write([]byte("\x01unwatch\x00prefix\x00svc.foo."))
+	expect(watcher, "\x01ok")
+}
+
+// the last notification has to be what the store ended up with, however the writes raced
+func TestWatchOrder(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := &server{
+		store:    kv.NewStore("1.0"),
+		extended: true,
+		watches:  makeWatcher(16, 16, time.Minute),
+		workers:  4,
+		c:        c,
+	}
+	go s.serve()
+
+	cl, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	cl.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, maxDatagram)
+	cl.Write([]byte("\x01watch\x00key\x0030\x00foo"))
+	n, err := cl.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := strings.CutPrefix(string(b[:n]), "\x01challenge\x00")
+	cl.Write([]byte("\x01confirm\x00" + token))
+	n, err = cl.Read(b)
+	if err != nil || string(b[:n]) != "\x01ok\x0030" {
+		t.Fatalf("wrong watch reply. expected %q got %q %v", "\x01ok\x0030", b[:n], err)
+	}
+
+	m := s.store.Namespace("")
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 25 {
+				m.Insert("foo", strconv.Itoa(i*25+j))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var last string
+	for seq := 1; seq <= 100; seq++ {
+		n, err := cl.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.SplitN(string(b[:n]), "\x00", 3)
+		if parts[1] != strconv.Itoa(seq) {
+			t.Fatalf("wrong seq. expected %v got %q", seq, b[:n])
+		}
+		last = parts[2]
+	}
+	value, _ := m.Get("foo")
+	if last != "foo="+value {
+		t.Fatalf("wrong last notification. expected %q got %q", "foo="+value, last)
+	}
+}
@@ -1,136 +1,86 @@
 package main
 
 import (
-	"bufio"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net"
-	"strings"
+	"time"
+)
+
+var (
+	ErrNoUpstream = fmt.Errorf("no upstream reachable")
 )
 
 func main() {
-	addr := ":8000"
-	ln, err := net.Listen("tcp", addr)
+	configPath := flag.String("config", "", "config file with upstreams and rewrite rules, see config.go. empty means boguscoin to the official server")
+	reloadEvery := flag.Duration("reload", 2*time.Second, "how often to check the config file for changes")
+	framerName := flag.String("framer", "newline", "how to split messages. newline, length (4 byte length prefix), speed (6_speed) or pest (11_pest)")
+	dropRate := flag.Float64("drop", 0, "fraction of messages to drop each way, for fault injection")
+	dialTimeout := flag.Duration("dial-timeout", 5*time.Second, "how long to wait on each upstream")
+	dialRetries := flag.Int("dial-retries", 3, "extra times to go through the upstreams when none of them answer")
+	dialBackoff := flag.Duration("dial-backoff", 200*time.Millisecond, "wait before the first retry, doubling after that")
+	checkEvery := flag.Duration("check", 10*time.Second, "how often to check which upstreams are up")
+	flag.Parse()
+
+	framer, err := getFramer(*framerName)
 	if err != nil {
 		panic(err)
 	}
 
-	log.Println("Server listening at " + addr)
-
-	defer ln.Close()
-
-	for {
-		c, err := ln.Accept()
+	live := &liveConfig{}
+	if *configPath == "" {
+		c, err := defaultConfig.compile()
 		if err != nil {
 			panic(err)
 		}
-		go handleConnection(c)
-	}
-}
-
-func connToChan(conn net.Conn) chan string {
-	cli_to_up := make(chan string)
-	r := bufio.NewReader(conn)
-	go func() {
-		// using this instead of scanner to prevent EOF packets without trailing newlines from being sent
-		for {
-			data, err := r.ReadBytes('\n')
-			if err != nil {
-				break
-			}
-			if len(data) > 0 { // strip the newline first
-				data = data[:len(data)-1]
-			}
-			cli_to_up <- string(data)
-		}
-		close(cli_to_up)
-	}()
-	return cli_to_up
-}
-
-func isAlphanum(s string) bool {
-	for _, c := range s {
-		uppercase := (c >= 'A') && (c <= 'Z')
-		lowercase := (c >= 'a') && (c <= 'z')
-		digits := (c >= '0') && (c <= '9')
-
-		if uppercase || lowercase || digits {
-			continue
+		live.set(c)
+	} else {
+		c, err := loadConfig(*configPath)
+		if err != nil {
+			panic(err)
 		}
-
-		return false
+		live.set(c)
+		go live.watch(*configPath, *reloadEvery)
 	}
-	return true
-}
 
-func boguscoined(s string) string {
-	tonycoin := "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
-	splits := strings.Split(s, " ")
-	rets := make([]string, 0)
-	for _, split := range splits {
-		if len(split) < 26 || len(split) > 35 {
-			rets = append(rets, split)
-			continue
-		}
-		if split[0] != '7' {
-			rets = append(rets, split)
-			continue
-		}
-
-		if !isAlphanum(split) {
-			rets = append(rets, split)
-			continue
-		}
-
-		rets = append(rets, tonycoin)
+	addr := ":8000"
+	up := makeUpstreams(*dialTimeout, *dialRetries, *dialBackoff)
+	go up.check(live, *checkEvery)
+
+	p := &proxy{
+		framer:     framer,
+		live:       live,
+		up:         up,
+		toUpstream: []Transform{rewrite(live, true)},
+		toClient:   []Transform{rewrite(live, false)},
+	}
+	if *dropRate > 0 {
+		p.toUpstream = append(p.toUpstream, dropRandomly(*dropRate))
+		p.toClient = append(p.toClient, dropRandomly(*dropRate))
 	}
-	return strings.Join(rets, " ")
-}
-
-func handleConnection(client net.Conn) {
-	log.Println(client.RemoteAddr(), "connected")
-	defer func() {
-		client.Close()
-		log.Println(client.RemoteAddr(), "disconnected")
-	}()
 
-	upstream, err := net.Dial("tcp", "chat.protohackers.com:16963")
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		panic(err)
 	}
-	log.Println("connected to upstream")
-	defer func() {
-		log.Println("upstream disconnected")
-		upstream.Close()
-	}()
 
-	cli_to_up := connToChan(client)
-	up_to_cli := connToChan(upstream)
+	log.Println("Server listening at " + addr)
 
-	for {
-		select {
-		case cli_to_up_msg, ok := <-cli_to_up:
-			if !ok {
-				return
-			}
-			log.Println("client say:", cli_to_up_msg)
-			doctored_msg := boguscoined(cli_to_up_msg)
-			_, err := upstream.Write([]byte(doctored_msg + "\n"))
-			if err != nil {
-				panic(err)
-			}
-			log.Println("relayed to upstream:", doctored_msg)
+	defer ln.Close()
 
-		case up_to_cli_msg, ok := <-up_to_cli:
-			if !ok {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-			log.Println("upstream say:", up_to_cli_msg)
-			doctored_msg := boguscoined(up_to_cli_msg)
-			_, err := client.Write([]byte(doctored_msg + "\n"))
-			if err != nil {
-				panic(err)
-			}
-			log.Println("relayed to client:", doctored_msg)
+			// out of file descriptors and such. whoever was trying can try again.
+			log.Println("accept:", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
 		}
+		go p.handle(c)
 	}
 }
@@ -1,8 +1,27 @@
 package main
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	pest "protohackers/11_pest/types"
+	speed "protohackers/6_speed/infra"
+	"reflect"
+	"testing"
+	"testing/iotest"
+	"time"
+)
 
 func TestBogus(t *testing.T) {
+	boguscoin, err := compileRules([]Rule{{Builtin: "boguscoin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	type bogusCases struct {
 		in       string
 		expected string
@@ -20,13 +39,326 @@ func TestBogus(t *testing.T) {
 			in:       "nice weather eh",
 			expected: "nice weather eh",
 		},
+		{
+			in:       "7F1u3wSD5RbOHQmupo9nx4TnhQ-1234 is not one",
+			expected: "7F1u3wSD5RbOHQmupo9nx4TnhQ-1234 is not one",
+		},
+		{
+			in:       "too short 7F1u3wSD5RbOHQmupo9nx4Tnh",
+			expected: "too short 7F1u3wSD5RbOHQmupo9nx4Tnh",
+		},
 	}
 
 	for _, c := range cases {
-		out := boguscoined(c.in)
+		out := boguscoin.apply(c.in)
 		if out != c.expected {
 			t.Fatalf("failed to transform boguscoin \"%v\".\nexpected \"%v\".\n got \"%v\".", c.in, c.expected, out)
 		}
 	}
 
 }
+
+func TestRules(t *testing.T) {
+	type ruleCases struct {
+		rules    []Rule
+		in       string
+		expected string
+	}
+	cases := []ruleCases{
+		// token with a template
+		{
+			[]Rule{{Match: "token", Pattern: "#([0-9]+)", Replace: "issue-$1"}},
+			"see #12 and #3a",
+			"see issue-12 and #3a",
+		},
+		// bounds on the token
+		{
+			[]Rule{{Match: "token", MinLen: 3, MaxLen: 4, Replace: "x"}},
+			"a bb ccc dddd eeeee",
+			"a bb x x eeeee",
+		},
+		// regex anywhere in the line, bounds on the match
+		{
+			[]Rule{{Match: "regex", Pattern: "[0-9]+", MaxLen: 2, Replace: "<$0>"}},
+			"1 22 333 a4",
+			"<1> <22> 333 a<4>",
+		},
+		// in order, each on what the last one left
+		{
+			[]Rule{
+				{Match: "regex", Pattern: "cat", Replace: "dog"},
+				{Match: "regex", Pattern: "dog", Replace: "wolf"},
+			},
+			"cat dog",
+			"wolf wolf",
+		},
+		// built-ins can send the money elsewhere
+		{
+			[]Rule{{Builtin: "boguscoin", Replace: "7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX"}},
+			"pay 7F1u3wSD5RbOHQmupo9nx4TnhQ now",
+			"pay 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX now",
+		},
+	}
+
+	for i, c := range cases {
+		rs, err := compileRules(c.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := rs.apply(c.in)
+		if out != c.expected {
+			t.Fatalf("wrong rewrite for case %v. expected %q got %q", i, c.expected, out)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	type configCases struct {
+		file string
+		err  error
+	}
+	cases := []configCases{
+		{`{"upstreams": ["a:1", "b:2"], "to_upstream": [{"builtin": "boguscoin"}]}`, nil},
+		{`{"to_upstream": [{"builtin": "boguscoin"}]}`, ErrNoUpstreams},
+		{`{"upstreams": ["a:1"], "to_client": [{"builtin": "nope"}]}`, ErrUnknownBuiltin},
+		{`{"upstreams": ["a:1"], "to_client": [{"match": "glob"}]}`, ErrUnknownMatch},
+	}
+
+	for i, c := range cases {
+		path := filepath.Join(dir, "config.json")
+		err := os.WriteFile(path, []byte(c.file), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = loadConfig(path)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("wrong error for case %v. expected %v got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestFramers(t *testing.T) {
+	type framerCases struct {
+		framer string
+		msgs   []any
+	}
+	cases := []framerCases{
+		{"newline", []any{"hello", "", "7F1u3wSD5RbOHQmupo9nx4TnhQ"}},
+		{"length", []any{[]byte("hello"), []byte{}, []byte{0, 1, 2}}},
+		{"speed", []any{
+			&speed.IAmACamera{Road: 66, Mile: 100, Limit: 60},
+			&speed.Plate{Plate: "UN1X", Timestamp: 1000},
+			speed.Heartbeat{},
+		}},
+		{"pest", []any{
+			pest.Hello{Protocol: "pestcontrol", Version: 1},
+			pest.SiteVisit{Site: 12345, Populations: []pest.SiteVisitEntry{{Species: "long-tailed rat", Count: 20}}},
+			pest.OK{},
+		}},
+	}
+
+	for _, c := range cases {
+		f, err := getFramer(c.framer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		for _, m := range c.msgs {
+			err := f.Write(&b, m)
+			if err != nil {
+				t.Fatalf("can't write %v with %v: %v", m, c.framer, err)
+			}
+		}
+		// garbage passes through untouched
+		if c.framer != "newline" {
+			b.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff})
+		}
+
+		// a byte at a time, so nothing relies on whole messages arriving at once
+		got := make([]any, 0)
+		for m := range f.Read(iotest.OneByteReader(&b)) {
+			got = append(got, m)
+		}
+
+		// whatever the garbage came out as, it has to write back the same
+		var rest bytes.Buffer
+		for _, m := range got[min(len(got), len(c.msgs)):] {
+			err := f.Write(&rest, m)
+			if err != nil {
+				t.Fatalf("can't write %#v back with %v: %v", m, c.framer, err)
+			}
+		}
+		got = got[:min(len(got), len(c.msgs))]
+
+		if !reflect.DeepEqual(got, c.msgs) {
+			t.Fatalf("wrong messages for %v. expected %#v got %#v", c.framer, c.msgs, got)
+		}
+		if c.framer != "newline" && !bytes.Equal(rest.Bytes(), []byte{0xff, 0xff, 0xff, 0xff, 0xff}) {
+			t.Fatalf("wrong bytes after the messages for %v. got %v", c.framer, rest.Bytes())
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	// upstream that echoes every line back
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	go func() {
+		for {
+			c, err := up.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	live := &liveConfig{}
+	c, err := Config{
+		Upstreams:  []string{up.Addr().String()},
+		ToUpstream: []Rule{{Builtin: "boguscoin"}},
+	}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.set(c)
+
+	p := &proxy{
+		framer:     newlineFramer{},
+		live:       live,
+		up:         makeUpstreams(time.Second, 0, 0),
+		toUpstream: []Transform{rewrite(live, true)},
+		toClient: []Transform{
+			rewrite(live, false),
+			func(msg any) (any, bool) {
+				return msg, msg != "drop me"
+			},
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(c)
+		}
+	}()
+
+	cl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	cl.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(cl, "pay 7F1u3wSD5RbOHQmupo9nx4TnhQ\ndrop me\nhi\n")
+	r := bufio.NewReader(cl)
+	for _, exp := range []string{"pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI\n", "hi\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != exp {
+			t.Fatalf("wrong line. expected %q got %q", exp, line)
+		}
+	}
+}
+
+// an address nothing listens on
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func TestFailover(t *testing.T) {
+	alive, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	dead := deadAddr(t)
+	addrs := []string{dead, alive.Addr().String()}
+
+	u := makeUpstreams(time.Second, 2, time.Millisecond)
+	c, err := u.dial(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c.RemoteAddr().String() != alive.Addr().String() {
+		t.Fatalf("wrong upstream. expected %v got %v", alive.Addr(), c.RemoteAddr())
+	}
+
+	// the dead one goes last from now on
+	order := u.order(addrs)
+	if !reflect.DeepEqual(order, []string{alive.Addr().String(), dead}) {
+		t.Fatalf("wrong order. got %v", order)
+	}
+
+	alive.Close()
+	_, err = u.dial(addrs)
+	if !errors.Is(err, ErrNoUpstream) {
+		t.Fatalf("wrong error with everything down. expected %v got %v", ErrNoUpstream, err)
+	}
+}
+
+func TestNoUpstreamNotice(t *testing.T) {
+	live := &liveConfig{}
+	c, err := Config{Upstreams: []string{deadAddr(t)}}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.set(c)
+
+	type noticeCases struct {
+		framer string
+		exp    any
+	}
+	cases := []noticeCases{
+		{"newline", "proxy: no upstream reachable"},
+		{"speed", &speed.SpeedError{Msg: "proxy: no upstream reachable"}},
+		{"pest", pest.Error{Message: "proxy: no upstream reachable"}},
+	}
+
+	for _, nc := range cases {
+		f, err := getFramer(nc.framer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &proxy{
+			framer: f,
+			live:   live,
+			up:     makeUpstreams(time.Second, 1, time.Millisecond),
+		}
+
+		client, server := net.Pipe()
+		go p.handle(server)
+
+		got := make([]any, 0)
+		for m := range f.Read(client) {
+			got = append(got, m)
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], nc.exp) {
+			t.Fatalf("wrong notice for %v. expected %#v got %#v", nc.framer, nc.exp, got)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoUpstreams = fmt.Errorf("config needs at least one upstream")
+)
+
+// What the proxy connects to and how it rewrites things on the way through.
+// The file is json, looking like
+//
+//	{
+//		"upstreams": ["chat.protohackers.com:16963"],
+//		"to_upstream": [{"builtin": "boguscoin"}],
+//		"to_client": [
+//			{"builtin": "boguscoin"},
+//			{"match": "regex", "pattern": "(?i)tony", "replace": "a very trustworthy person"}
+//		]
+//	}
+//
+// Upstreams are tried in order. Rules are applied in order, see Rule for what goes in one.
+type Config struct {
+	Upstreams  []string `json:"upstreams"`
+	ToUpstream []Rule   `json:"to_upstream"`
+	ToClient   []Rule   `json:"to_client"`
+}
+
+// Config with its rules compiled
+type config struct {
+	upstreams  []string
+	toUpstream ruleSet
+	toClient   ruleSet
+}
+
+// what the proxy did before it had a config file
+var defaultConfig = Config{
+	Upstreams:  []string{"chat.protohackers.com:16963"},
+	ToUpstream: []Rule{{Builtin: "boguscoin"}},
+	ToClient:   []Rule{{Builtin: "boguscoin"}},
+}
+
+func (c Config) compile() (*config, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, ErrNoUpstreams
+	}
+
+	toUpstream, err := compileRules(c.ToUpstream)
+	if err != nil {
+		return nil, fmt.Errorf("to_upstream: %w", err)
+	}
+	toClient, err := compileRules(c.ToClient)
+	if err != nil {
+		return nil, fmt.Errorf("to_client: %w", err)
+	}
+
+	return &config{
+		upstreams:  c.Upstreams,
+		toUpstream: toUpstream,
+		toClient:   toClient,
+	}, nil
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Config
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	ret, err := c.compile()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return ret, nil
+}
+
+// The config every session is using right now.
+// Rules changed by a reload apply to the very next line, even on sessions that are already open.
+// New upstreams only matter for new sessions.
+type liveConfig struct {
+	c  *config
+	mu sync.RWMutex
+}
+
+func (l *liveConfig) get() *config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.c
+}
+
+func (l *liveConfig) set(c *config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.c = c
+}
+
+// reloads the file every time it changes. a broken file is logged and the old config stays.
+// never returns.
+func (l *liveConfig) watch(path string, every time.Duration) {
+	var last time.Time
+	fi, err := os.Stat(path)
+	if err == nil {
+		last = fi.ModTime()
+	}
+
+	for range time.Tick(every) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Println("config:", err)
+			continue
+		}
+		if fi.ModTime().Equal(last) {
+			continue
+		}
+		last = fi.ModTime()
+
+		c, err := loadConfig(path)
+		if err != nil {
+			log.Println("not reloading config:", err)
+			continue
+		}
+		l.set(c)
+		log.Println("reloaded config from", path)
+	}
+}
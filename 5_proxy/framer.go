@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	pest "protohackers/11_pest/infra"
+	"protohackers/11_pest/types"
+	speed "protohackers/6_speed/infra"
+)
+
+var (
+	ErrUnknownFramer = fmt.Errorf("framer has to be newline, length, speed or pest")
+	ErrCantEncode    = fmt.Errorf("framer doesn't know how to write that")
+)
+
+// Splits a stream into messages and writes them back out.
+//
+// Bytes a framer can't make sense of come out as Raw, along with everything after them
+// since there is no telling where the next message starts. Raw gets written as is by every framer.
+// The speed framer hands out an UndefinedType per unknown byte instead, which is how 6_speed sees them too.
+type Framer interface {
+	// reads messages until r fails, then closes the channel
+	Read(r io.Reader) chan any
+	Write(w io.Writer, msg any) error
+	// a message telling the other end something went wrong, in whatever way the protocol does that
+	Notice(text string) any
+}
+
+type Raw []byte
+
+var framers = map[string]Framer{
+	"newline": newlineFramer{},
+	"length":  lengthFramer{},
+	"speed":   speedFramer{},
+	"pest":    pestFramer{},
+}
+
+func getFramer(name string) (Framer, error) {
+	f, ok := framers[name]
+	if !ok {
+		return nil, ErrUnknownFramer
+	}
+	return f, nil
+}
+
+// passes everything left in r on as Raw
+func readRaw(r io.Reader, ch chan any) {
+	for {
+		b := make([]byte, 1024)
+		n, err := r.Read(b)
+		if n > 0 {
+			ch <- Raw(b[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Lines of text, as strings without the newline.
+type newlineFramer struct{}
+
+func (newlineFramer) Read(r io.Reader) chan any {
+	ch := make(chan any)
+	br := bufio.NewReader(r)
+	go func() {
+		defer close(ch)
+		// using this instead of scanner to prevent EOF packets without trailing newlines from being sent
+		for {
+			data, err := br.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			ch <- string(data[:len(data)-1])
+		}
+	}()
+	return ch
+}
+
+func (newlineFramer) Write(w io.Writer, msg any) error {
+	switch v := msg.(type) {
+	case string:
+		_, err := io.WriteString(w, v+"\n")
+		return err
+	case Raw:
+		_, err := w.Write(v)
+		return err
+	}
+	return ErrCantEncode
+}
+
+func (newlineFramer) Notice(text string) any {
+	return text
+}
+
+// anything longer is taken as garbage
+const maxFrame = 1 << 24
+
+// A 4 byte big endian length, then that many bytes. Messages are the []byte after the length.
+type lengthFramer struct{}
+
+func (lengthFramer) Read(r io.Reader) chan any {
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		br := bufio.NewReader(r)
+		for {
+			var l [4]byte
+			_, err := io.ReadFull(br, l[:])
+			if err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(l[:])
+			if n > maxFrame {
+				ch <- Raw(l[:])
+				readRaw(br, ch)
+				return
+			}
+
+			b := make([]byte, n)
+			_, err = io.ReadFull(br, b)
+			if err != nil {
+				return
+			}
+			ch <- b
+		}
+	}()
+	return ch
+}
+
+func (lengthFramer) Write(w io.Writer, msg any) error {
+	switch v := msg.(type) {
+	case []byte:
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(v)))
+		_, err := w.Write(append(b, v...))
+		return err
+	case Raw:
+		_, err := w.Write(v)
+		return err
+	}
+	return ErrCantEncode
+}
+
+func (lengthFramer) Notice(text string) any {
+	return []byte(text)
+}
+
+// Speed daemon messages, the pointers 6_speed/infra parses them into.
+type speedFramer struct{}
+
+func (speedFramer) Read(r io.Reader) chan any {
+	return speed.ParseMessages(r, nil)
+}
+
+func (speedFramer) Write(w io.Writer, msg any) error {
+	switch v := msg.(type) {
+	case speed.Encode:
+		_, err := w.Write(v.Encode())
+		return err
+	case Raw:
+		_, err := w.Write(v)
+		return err
+	}
+	return ErrCantEncode
+}
+
+func (speedFramer) Notice(text string) any {
+	return &speed.SpeedError{Msg: text}
+}
+
+// Pest control messages, the values in 11_pest/types.
+type pestFramer struct{}
+
+func (pestFramer) Read(r io.Reader) chan any {
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		var curr []byte
+		for {
+			b := make([]byte, 1024)
+			n, err := r.Read(b)
+			curr = append(curr, b[:n]...)
+
+			for len(curr) > 0 {
+				res := pest.Parse(curr)
+				if errors.Is(res.Error, pest.ErrNotEnough) {
+					break
+				}
+				if res.Error != nil {
+					ch <- Raw(curr)
+					readRaw(r, ch)
+					return
+				}
+				ch <- res.Value
+				curr = res.Next
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (pestFramer) Write(w io.Writer, msg any) error {
+	if v, ok := msg.(Raw); ok {
+		_, err := w.Write(v)
+		return err
+	}
+	b := pest.Encode(msg)
+	if b == nil {
+		return ErrCantEncode
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func (pestFramer) Notice(text string) any {
+	return types.Error{Message: text}
+}
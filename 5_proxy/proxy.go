@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+)
+
+// Gets every message going one way and returns what to send on instead.
+// Returning false drops the message.
+type Transform func(msg any) (any, bool)
+
+// Sits between a client and an upstream, passing messages both ways.
+// The framer decides what a message is, the transforms get a look at each one in order.
+//
+// Whatever goes wrong in a session only ends that session, the client and its upstream get closed together.
+// A session never moves to another upstream halfway through, since the new one wouldn't know what the old one was told.
+type proxy struct {
+	framer     Framer
+	live       *liveConfig
+	up         *upstreams
+	toUpstream []Transform
+	toClient   []Transform
+}
+
+// the rewrite rules from the config, for text messages.
+// looks the rules up on every message so reloads apply right away.
+func rewrite(live *liveConfig, toUpstream bool) Transform {
+	return func(msg any) (any, bool) {
+		line, ok := msg.(string)
+		if !ok {
+			return msg, true
+		}
+		c := live.get()
+		if toUpstream {
+			return c.toUpstream.apply(line), true
+		}
+		return c.toClient.apply(line), true
+	}
+}
+
+// drops about rate of the messages, 0 to 1
+func dropRandomly(rate float64) Transform {
+	return func(msg any) (any, bool) {
+		return msg, rand.Float64() >= rate
+	}
+}
+
+func (p *proxy) handle(client net.Conn) {
+	log.Println(client.RemoteAddr(), "connected")
+	defer func() {
+		client.Close()
+		log.Println(client.RemoteAddr(), "disconnected")
+	}()
+
+	upstream, err := p.up.dial(p.live.get().upstreams)
+	if err != nil {
+		log.Println(client.RemoteAddr(), err)
+		p.framer.Write(client, p.framer.Notice("proxy: "+err.Error()))
+		return
+	}
+	log.Println("connected to upstream", upstream.RemoteAddr())
+	defer func() {
+		log.Println("upstream disconnected")
+		upstream.Close()
+	}()
+
+	cli_to_up := p.framer.Read(client)
+	up_to_cli := p.framer.Read(upstream)
+	// the readers stop once the connections close, as long as nobody is stuck waiting on them
+	defer func() {
+		go drain(cli_to_up)
+		go drain(up_to_cli)
+	}()
+
+	for {
+		select {
+		case msg, ok := <-cli_to_up:
+			if !ok {
+				return
+			}
+			log.Printf("client say: %v", msg)
+			err := p.relay(upstream, msg, p.toUpstream, "upstream")
+			if err != nil {
+				log.Println("relaying to upstream:", err)
+				return
+			}
+
+		case msg, ok := <-up_to_cli:
+			if !ok {
+				return
+			}
+			log.Printf("upstream say: %v", msg)
+			err := p.relay(client, msg, p.toClient, "client")
+			if err != nil {
+				log.Println("relaying to client:", err)
+				return
+			}
+		}
+	}
+}
+
+func (p *proxy) relay(w io.Writer, msg any, transforms []Transform, to string) error {
+	for _, t := range transforms {
+		var ok bool
+		msg, ok = t(msg)
+		if !ok {
+			log.Printf("dropped on the way to %v", to)
+			return nil
+		}
+	}
+
+	err := p.framer.Write(w, msg)
+	if err != nil {
+		return err
+	}
+	log.Printf("relayed to %v: %v", to, msg)
+	return nil
+}
+
+func drain(ch chan any) {
+	for range ch {
+	}
+}
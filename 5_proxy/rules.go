@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrUnknownMatch   = fmt.Errorf("match has to be token or regex")
+	ErrUnknownBuiltin = fmt.Errorf("no built-in rule set by that name")
+)
+
+// Rewrites part of a line.
+//
+// Token rules look at every space separated word on its own, and replace the whole word
+// if it is between MinLen and MaxLen long and the pattern matches all of it.
+// Regex rules replace every match of the pattern anywhere in the line, as long as the match is within the bounds.
+//
+// Replace is a template, $0 is what matched and $1, ${name} and so on are the groups in the pattern.
+// An empty pattern matches anything, which only makes sense for token rules.
+type Rule struct {
+	// puts a whole built-in rule set here instead, see builtins.
+	// if Replace is set it replaces what the built-in rules would put in.
+	Builtin string `json:"builtin,omitempty"`
+
+	Match   string `json:"match,omitempty"` // token or regex
+	Pattern string `json:"pattern,omitempty"`
+	MinLen  int    `json:"min_len,omitempty"`
+	MaxLen  int    `json:"max_len,omitempty"` // 0 means no limit
+	Replace string `json:"replace,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// tony's address, where all boguscoin should go
+const tonycoin = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+
+// rule sets that can be pulled into a config by name
+var builtins = map[string][]Rule{
+	// a boguscoin address is a word starting with 7,
+	// 26 to 35 letters and digits long
+	"boguscoin": {
+		{
+			Match:   "token",
+			Pattern: "7[a-zA-Z0-9]*",
+			MinLen:  26,
+			MaxLen:  35,
+			Replace: tonycoin,
+		},
+	},
+}
+
+// Rules applied one after the other, each on what the last one left.
+type ruleSet []*Rule
+
+// expands built-ins and compiles every pattern
+func compileRules(rules []Rule) (ruleSet, error) {
+	ret := make(ruleSet, 0, len(rules))
+	for i, r := range rules {
+		if r.Builtin != "" {
+			set, ok := builtins[r.Builtin]
+			if !ok {
+				return nil, fmt.Errorf("rule %v: %w: %v", i, ErrUnknownBuiltin, r.Builtin)
+			}
+			for _, b := range set {
+				if r.Replace != "" {
+					b.Replace = r.Replace
+				}
+				err := b.compile()
+				if err != nil {
+					return nil, fmt.Errorf("rule %v: %w", i, err)
+				}
+				ret = append(ret, &b)
+			}
+			continue
+		}
+
+		err := r.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %v: %w", i, err)
+		}
+		ret = append(ret, &r)
+	}
+	return ret, nil
+}
+
+func (r *Rule) compile() error {
+	var err error
+	switch r.Match {
+	case "token":
+		pattern := r.Pattern
+		if pattern == "" {
+			pattern = ".*"
+		}
+		// the whole token has to match, not just part of it
+		r.re, err = regexp.Compile("^(?:" + pattern + ")$")
+	case "regex":
+		r.re, err = regexp.Compile(r.Pattern)
+	default:
+		return ErrUnknownMatch
+	}
+	return err
+}
+
+func (r *Rule) inBounds(s string) bool {
+	return len(s) >= r.MinLen && (r.MaxLen == 0 || len(s) <= r.MaxLen)
+}
+
+func (r *Rule) apply(line string) string {
+	if r.Match == "token" {
+		// split on single spaces so the spacing comes back out exactly the same
+		tokens := strings.Split(line, " ")
+		for i, tok := range tokens {
+			if !r.inBounds(tok) {
+				continue
+			}
+			m := r.re.FindStringSubmatchIndex(tok)
+			if m == nil {
+				continue
+			}
+			tokens[i] = string(r.re.ExpandString(nil, r.Replace, tok, m))
+		}
+		return strings.Join(tokens, " ")
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range r.re.FindAllStringSubmatchIndex(line, -1) {
+		if !r.inBounds(line[m[0]:m[1]]) {
+			continue
+		}
+		b.WriteString(line[last:m[0]])
+		b.Write(r.re.ExpandString(nil, r.Replace, line, m))
+		last = m[1]
+	}
+	b.WriteString(line[last:])
+	return b.String()
+}
+
+func (rs ruleSet) apply(line string) string {
+	for _, r := range rs {
+		line = r.apply(line)
+	}
+	return line
+}
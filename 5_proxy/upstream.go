@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Keeps track of which upstreams are up.
+//
+// Sessions try the healthy ones first, in the order the config lists them,
+// then the rest as a last resort since a check can be out of date.
+// If every one of them fails it waits and goes through the list again, backing off each time.
+type upstreams struct {
+	down    map[string]bool // by address. anything not in here counts as up.
+	timeout time.Duration   // per dial
+	retries int             // extra rounds through the list after the first one
+	backoff time.Duration   // before the first retry, doubling after that
+	mu      sync.Mutex
+}
+
+func makeUpstreams(timeout time.Duration, retries int, backoff time.Duration) *upstreams {
+	return &upstreams{
+		down:    make(map[string]bool),
+		timeout: timeout,
+		retries: retries,
+		backoff: backoff,
+	}
+}
+
+func (u *upstreams) mark(addr string, up bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.down[addr] == !up {
+		return
+	}
+	if up {
+		delete(u.down, addr)
+		log.Printf("upstream %v is up", addr)
+	} else {
+		u.down[addr] = true
+		log.Printf("upstream %v is down", addr)
+	}
+}
+
+// healthy first, otherwise in the same order
+func (u *upstreams) order(addrs []string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ret := slices.Clone(addrs)
+	slices.SortStableFunc(ret, func(a, b string) int {
+		switch {
+		case u.down[a] == u.down[b]:
+			return 0
+		case u.down[a]:
+			return 1
+		}
+		return -1
+	})
+	return ret
+}
+
+func (u *upstreams) dialOne(addr string) (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", addr, u.timeout)
+	u.mark(addr, err == nil)
+	return c, err
+}
+
+// first upstream that answers
+func (u *upstreams) dial(addrs []string) (net.Conn, error) {
+	backoff := u.backoff
+	for round := 0; ; round++ {
+		for _, addr := range u.order(addrs) {
+			c, err := u.dialOne(addr)
+			if err == nil {
+				return c, nil
+			}
+			log.Printf("upstream %v: %v", addr, err)
+		}
+
+		if round >= u.retries {
+			return nil, ErrNoUpstream
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// dials every upstream in the config now and then, just to see if it's there.
+// never returns.
+func (u *upstreams) check(live *liveConfig, every time.Duration) {
+	for range time.Tick(every) {
+		for _, addr := range live.get().upstreams {
+			c, err := u.dialOne(addr)
+			if err == nil {
+				c.Close()
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net"
 	"protohackers/6_speed/infra"
@@ -10,6 +11,14 @@ import (
 )
 
 func main() {
+	dataDir := flag.String("data", "speed_data", "directory to journal plates and tickets in. nothing is kept if empty")
+	syncEvery := flag.Duration("sync", 100*time.Millisecond, "how often the journal gets fsynced. a crashed machine loses at most this much")
+	compactEvery := flag.Duration("compact", 10*time.Minute, "how often the journal drops plates too old to make a ticket")
+	lateness := flag.Duration("lateness", 24*time.Hour, "how far behind the newest plate on a road a plate can come in and still make a ticket after a restart")
+	strategy := flag.String("strategy", "random", "how tickets get split between a road's dispatchers. random, round-robin, least-outstanding or sticky (same car, same dispatcher)")
+	statsEvery := flag.Duration("stats", time.Minute, "how often to log what every dispatcher delivered. never if 0")
+	flag.Parse()
+
 	addr := ":8000"
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -21,6 +30,43 @@ func main() {
 	defer ln.Close()
 
 	ctrl := ticketing.MakeController()
+	if *dataDir != "" {
+		ctrl, err = ticketing.Open(*dataDir, *lateness)
+		if err != nil {
+			panic(err)
+		}
+		defer ctrl.Close()
+
+		go func() {
+			for range time.Tick(*syncEvery) {
+				err := ctrl.Sync()
+				if err != nil {
+					log.Println("sync failed:", err)
+				}
+			}
+		}()
+		go func() {
+			for range time.Tick(*compactEvery) {
+				err := ctrl.Compact()
+				if err != nil {
+					log.Println("compaction failed:", err)
+				}
+			}
+		}()
+	}
+	err = ctrl.UseStrategy(*strategy)
+	if err != nil {
+		panic(err)
+	}
+	if *statsEvery > 0 {
+		go func() {
+			for range time.Tick(*statsEvery) {
+				for _, st := range ctrl.Stats() {
+					log.Printf("dispatcher %v on roads %v: %v delivered, %v outstanding", st.ID, st.Roads, st.Delivered, st.Outstanding)
+				}
+			}
+		}()
+	}
 
 	for {
 		c, err := ln.Accept()
@@ -97,8 +143,8 @@ func handleConnectionLogic(ctx context.Context, incoming chan any, outgoing chan
 				for {
 					select {
 					case <-ctx.Done():
+						// not closing outgoing, the dispatcher might still be trying to send on it
 						log.Println("stopped heartbeat every", v.Interval, "ds")
-						close(outgoing)
 						return
 					case outgoing <- infra.Heartbeat{}:
 						deciseconds := time.Second / 10
@@ -127,13 +173,8 @@ func handleConnectionLogic(ctx context.Context, incoming chan any, outgoing chan
 				continue
 			}
 
-			ch := make(chan *infra.Ticket)
-			go func() {
-				for c := range ch {
-					outgoing <- c
-				}
-			}()
-			ctrl.AddDispatcher(v.Roads, ch)
+			d := ctrl.AddDispatcher(v.Roads)
+			go deliverTickets(ctx, d, outgoing, ctrl)
 			clientType = Dispatcher
 			log.Printf("new dispatcher on roads %v\n", v.Roads)
 
@@ -142,3 +183,34 @@ func handleConnectionLogic(ctx context.Context, incoming chan any, outgoing chan
 		}
 	}
 }
+
+// writes the dispatcher's tickets one at a time, until the connection goes away.
+// then it's unregistered and whatever it didn't get goes to another dispatcher.
+func deliverTickets(ctx context.Context, d *ticketing.Dispatcher, outgoing chan infra.Encode, ctrl *ticketing.Controller) {
+	defer func() {
+		ctrl.RemoveDispatcher(d)
+		st := d.Stats()
+		log.Printf("dispatcher %v gone after delivering %v tickets", st.ID, st.Delivered)
+	}()
+
+	for {
+		t, ok := d.Next(ctx)
+		if !ok {
+			return
+		}
+
+		done := make(chan error, 1)
+		select {
+		case outgoing <- infra.Confirmed{Msg: t, Done: done}:
+		case <-ctx.Done():
+			return
+		}
+		// the encoder always answers once it took it, connection gone or not
+		err := <-done
+		if err != nil {
+			log.Println("ticket not delivered:", err)
+			return
+		}
+		d.Delivered(t)
+	}
+}
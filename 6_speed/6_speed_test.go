@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"net"
 	"protohackers/6_speed/infra"
 	"protohackers/6_speed/ticketing"
 	"testing"
+	"time"
 )
 
 func TestLogic(t *testing.T) {
@@ -41,3 +43,38 @@ func TestLogic(t *testing.T) {
 		Timestamp: 0,
 	}
 }
+
+// a dispatcher that hangs up never swallows a ticket, the next one gets it
+func TestDispatcherDisconnect(t *testing.T) {
+	ctrl := ticketing.MakeController()
+	ctrl.UpdateLimit(123, 60)
+
+	dispatcher := func() net.Conn {
+		client, server := net.Pipe()
+		go handleConnection(server, ctrl)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := client.Write((&infra.IAmADispatcher{Roads: []uint16{123}}).Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	gone := dispatcher()
+	gone.Close()
+
+	ctrl.AddPlates(&ticketing.Plate{Plate: "UN1X", Road: 123, Mile: 8, Timestamp: 0})
+	ctrl.AddPlates(&ticketing.Plate{Plate: "UN1X", Road: 123, Mile: 9, Timestamp: 45})
+
+	d := dispatcher()
+	defer d.Close()
+
+	msg, ok := <-infra.ParseMessages(d, nil)
+	if !ok {
+		t.Fatalf("expected a ticket, connection closed")
+	}
+	tick, ok := msg.(*infra.Ticket)
+	if !ok || tick.Plate != "UN1X" {
+		t.Fatalf("expected the ticket for UN1X. got %#v", msg)
+	}
+}
@@ -3,6 +3,7 @@ package infra_test
 import (
 	"bytes"
 	"protohackers/6_speed/infra"
+	"reflect"
 	"testing"
 )
 
@@ -34,3 +35,34 @@ func TestEncode(t *testing.T) {
 		t.Fatalf("failed to serialize %v", ticket)
 	}
 }
+
+func TestEncodeRoundTrip(t *testing.T) {
+	msgs := []infra.Encode{
+		&infra.Plate{Plate: "UN1X", Timestamp: 1000},
+		&infra.WantHeartbeat{Interval: 10},
+		&infra.IAmACamera{Road: 66, Mile: 100, Limit: 60},
+		&infra.IAmADispatcher{Roads: []uint16{66, 368, 5000}},
+		&infra.Ticket{Plate: "UN1X", Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: 10000},
+		infra.Heartbeat{},
+		&infra.SpeedError{Msg: "bad"},
+	}
+
+	var b []byte
+	for _, m := range msgs {
+		b = append(b, m.Encode()...)
+	}
+
+	i := 0
+	for out := range infra.ParseMessages(bytes.NewReader(b), nil) {
+		if i >= len(msgs) {
+			t.Fatalf("too many messages. expected %v", len(msgs))
+		}
+		if !reflect.DeepEqual(out, msgs[i]) {
+			t.Fatalf("wrong message %v. expected %#v got %#v", i, msgs[i], out)
+		}
+		i++
+	}
+	if i != len(msgs) {
+		t.Fatalf("wrong number of messages. expected %v got %v", len(msgs), i)
+	}
+}
@@ -10,6 +10,27 @@ type Encode interface {
 	Encode() []byte
 }
 
+// A message that wants to know whether it made it onto the connection.
+// Once EncodeMessages takes one off the channel, Written always gets called.
+type Confirm interface {
+	Encode
+	Written(err error)
+}
+
+// Confirms a message by sending the write error (or nil) on Done, which needs room for one.
+type Confirmed struct {
+	Msg  Encode
+	Done chan error
+}
+
+func (c Confirmed) Encode() []byte {
+	return c.Msg.Encode()
+}
+
+func (c Confirmed) Written(err error) {
+	c.Done <- err
+}
+
 func EncodeMessages(ctx context.Context, w io.Writer) chan Encode {
 	ch := make(chan Encode)
 
@@ -19,7 +40,10 @@ func EncodeMessages(ctx context.Context, w io.Writer) chan Encode {
 			case <-ctx.Done():
 				return
 			case v := <-ch:
-				w.Write(v.Encode())
+				_, err := w.Write(v.Encode())
+				if c, ok := v.(Confirm); ok {
+					c.Written(err)
+				}
 			}
 		}
 	}()
@@ -49,6 +73,39 @@ func (err *SpeedError) Encode() []byte {
 	return append([]byte{0x10}, encodeString(err.Msg)...)
 }
 
+// the rest are what clients send. the server never writes them,
+// but they're handy for anything sitting in between.
+
+func (p *Plate) Encode() []byte {
+	ret := append([]byte{0x20}, encodeString(p.Plate)...)
+	return binary.BigEndian.AppendUint32(ret, p.Timestamp)
+}
+
+func (w *WantHeartbeat) Encode() []byte {
+	return binary.BigEndian.AppendUint32([]byte{0x40}, w.Interval)
+}
+
+func (c *IAmACamera) Encode() []byte {
+	ret := []byte{0x80}
+	ret = binary.BigEndian.AppendUint16(ret, c.Road)
+	ret = binary.BigEndian.AppendUint16(ret, c.Mile)
+	ret = binary.BigEndian.AppendUint16(ret, c.Limit)
+	return ret
+}
+
+func (d *IAmADispatcher) Encode() []byte {
+	ret := []byte{0x81, uint8(len(d.Roads))}
+	for _, road := range d.Roads {
+		ret = binary.BigEndian.AppendUint16(ret, road)
+	}
+	return ret
+}
+
+// just the type byte it was parsed from
+func (u *UndefinedType) Encode() []byte {
+	return []byte{u.Data}
+}
+
 func encodeString(s string) []byte {
 	l := byte(uint8(len(s)))
 	return append([]byte{l}, []byte(s)...)
@@ -2,89 +2,52 @@ package ticketing
 
 import (
 	"log"
-	"slices"
+	"sort"
 )
 
 type car struct {
 	plateString string
-	plates      []*Plate
-	violations  map[int]*ticket
+	plates      []*Plate // sorted by time
 }
 
 func makeCar(plate string) *car {
 	return &car{
 		plateString: plate,
 		plates:      make([]*Plate, 0),
-		violations:  make(map[int]*ticket),
 	}
 }
 
-func (c *car) addPlate(pl *Plate) {
-	c.plates = append(c.plates, pl)
-
+// records the plate and returns the pairs it makes that are over the limit.
+// whether they turn into tickets is up to the day book.
+//
+// only the plates right before and after it in time can make a new pair with it,
+// every other pair was already looked at when it came in. so finding the spot is a binary search
+// and there are at most two pairs to check, no matter how many times the car was seen.
+// making room for it is still a copy of everything after it, which is nothing when plates come in order
+// and up to the whole list when they don't. it's only pointers, so that stays cheap for a while.
+func (c *car) addPlate(pl *Plate, limit float64) []*ticket {
 	log.Printf("Plate %v found on road %v mile %v time %v", pl.Plate, pl.Road, pl.Mile, pl.Timestamp)
 
-	slices.SortFunc(c.plates, func(a *Plate, b *Plate) int {
-		return int(a.Timestamp) - int(b.Timestamp)
+	// after any plate with the same time, same as it would have been sorted in
+	i := sort.Search(len(c.plates), func(i int) bool {
+		return c.plates[i].Timestamp > pl.Timestamp
 	})
-}
-
-// calculate traffic violations
-func (c *car) getViolations(limit float64) []*ticket {
-	c.registerViolations(limit)
+	c.plates = append(c.plates, nil)
+	copy(c.plates[i+1:], c.plates[i:])
+	c.plates[i] = pl
 
 	ret := make([]*ticket, 0)
-	added := make(map[*ticket]bool)
-
-	for _, v := range c.violations {
-		if added[v] {
-			continue
+	if i > 0 {
+		t := makeTicket(c.plates[i-1], pl)
+		if t.speed() > limit {
+			ret = append(ret, t)
 		}
-		ret = append(ret, v)
-		added[v] = true
 	}
-
-	return ret
-}
-
-// calculates traffic violations and registers it to the car
-func (c *car) registerViolations(limit float64) {
-	tickets := func() []*ticket {
-		tickets := make([]*ticket, 0)
-		for i, pl := range c.plates {
-			last := i - 1
-			if last < 0 || last >= len(c.plates) {
-				continue
-			}
-			lastPl := c.plates[last]
-
-			tick := makeTicket(lastPl, pl)
-			mph := tick.speed()
-
-			if mph <= limit {
-				continue
-			}
-
-			tickets = append(tickets, tick)
-		}
-		return tickets
-	}()
-
-	for _, t := range tickets {
-		collide := false
-		for _, d := range t.days() {
-			if c.violations[d] != nil {
-				collide = true
-				break
-			}
-		}
-
-		if collide {
-			continue
-		}
-
-		for _, d := range t.days() {
-			c.violations[d] = t
+	if i < len(c.plates)-1 {
+		t := makeTicket(pl, c.plates[i+1])
+		if t.speed() > limit {
+			ret = append(ret, t)
 		}
 	}
+	return ret
 }
@@ -1,9 +1,15 @@
 package ticketing
 
 import (
+	"cmp"
 	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
 	"protohackers/6_speed/infra"
+	"slices"
 	"sync"
+	"time"
 )
 
 type Plate struct {
@@ -17,47 +23,200 @@ func (pl *Plate) String() string {
 	return fmt.Sprintf("{%v %v %v %v}", pl.Mile, pl.Plate, pl.Road, pl.Timestamp)
 }
 
+// Roads each have their own lock, the controller only locks to find them.
+// Nothing ever holds two road locks at once, so dispatchers on several roads can't deadlock anything.
+// The order is always road, then the picker, then dispatcher, then the day book, with the journal last.
 type Controller struct {
-	roads map[uint16]*road
-	mu    sync.Mutex
+	roads        map[uint16]*road
+	book         *dayBook
+	journal      *journal // nil if nothing is persisted
+	picker       picker   // shared by every road
+	nextDispatch int
+	mu           sync.RWMutex
 }
 
 func MakeController() *Controller {
 	return &Controller{
-		roads: make(map[uint16]*road),
+		roads:  make(map[uint16]*road),
+		book:   makeDayBook(),
+		picker: strategies["random"](),
 	}
 }
 
-func (g *Controller) UpdateLimit(roadNum uint16, limit uint16) {
+// how roads pick a dispatcher for each ticket: random, round-robin, least-outstanding or sticky (see strategy.go).
+// meant to be set once at startup, roads that already have tickets in flight start over with the new one.
+func (g *Controller) UseStrategy(name string) error {
+	s, ok := strategies[name]
+	if !ok {
+		return ErrUnknownStrategy
+	}
+	p := s()
+
 	g.mu.Lock()
-	defer g.mu.Unlock()
+	g.picker = p
+	roads := slices.Collect(maps.Values(g.roads))
+	g.mu.Unlock()
 
-	rd := g.getRoad(roadNum)
-	rd.updateLimit(limit)
+	for _, rd := range roads {
+		rd.setPicker(p)
+	}
+	return nil
 }
 
-func (g *Controller) AddDispatcher(roads []uint16, ch chan *infra.Ticket) {
+// every dispatcher that's on a road right now, by id
+func (g *Controller) Stats() []DispatcherStats {
+	g.mu.RLock()
+	roads := slices.Collect(maps.Values(g.roads))
+	g.mu.RUnlock()
+
+	seen := make(map[*Dispatcher]bool)
+	for _, rd := range roads {
+		rd.mu.Lock()
+		for _, d := range rd.dispatchers {
+			seen[d] = true
+		}
+		rd.mu.Unlock()
+	}
+
+	ret := make([]DispatcherStats, 0, len(seen))
+	for d := range seen {
+		ret = append(ret, d.Stats())
+	}
+	slices.SortFunc(ret, func(a, b DispatcherStats) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return ret
+}
+
+// a controller that journals to dir, picking up from whatever is already there.
+// cars, days already ticketed and tickets that never got delivered all come back.
+// plates coming in up to lateness behind the newest one on their road still get ticketed after a restart.
+func Open(dir string, lateness time.Duration) (*Controller, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	st, size, err := readJournal(filepath.Join(dir, journalName))
+	if err != nil {
+		return nil, err
+	}
+	j, err := openJournal(dir, size, uint32(lateness/time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	g := MakeController()
+	g.journal = j
+	g.restore(st)
+	return g, nil
+}
+
+// puts the state back without journaling any of it again
+func (g *Controller) restore(st *journalState) {
+	for roadNum, limit := range st.limits {
+		g.getRoad(roadNum).limit = limit
+	}
+
+	cars := make(map[*car]bool)
+	for _, pl := range st.plates {
+		rd := g.getRoad(pl.Road)
+		rd.newest = max(rd.newest, pl.Timestamp)
+		c := rd.getCar(pl.Plate)
+		c.plates = append(c.plates, pl)
+		cars[c] = true
+	}
+	// stable, so plates with the same time stay in the order they came in, same as addPlate does it
+	for c := range cars {
+		slices.SortStableFunc(c.plates, func(a, b *Plate) int {
+			return cmp.Compare(a.Timestamp, b.Timestamp)
+		})
+	}
+
+	for _, t := range st.tickets {
+		g.book.claim(t)
+		if !st.delivered[t.key()] {
+			rd := g.getRoad(t.pl1.Road)
+			rd.pending = append(rd.pending, t)
+		}
+	}
+}
+
+// gets the journal onto the disk
+func (g *Controller) Sync() error {
+	return g.journal.sync()
+}
+
+// drops whatever in the journal can't matter any more, see journalState.compact
+func (g *Controller) Compact() error {
+	return g.journal.compact()
+}
+
+func (g *Controller) Close() error {
+	return g.journal.close()
+}
+
+func (g *Controller) UpdateLimit(roadNum uint16, limit uint16) {
+	g.getRoad(roadNum).updateLimit(limit)
+}
+
+// registers a dispatcher for roads. remove it with RemoveDispatcher once its connection is gone.
+func (g *Controller) AddDispatcher(roads []uint16) *Dispatcher {
 	g.mu.Lock()
-	defer g.mu.Unlock()
+	d := &Dispatcher{
+		id:       g.nextDispatch,
+		roads:    roads,
+		queue:    make([]*ticket, 0),
+		inflight: make(map[*infra.Ticket]*ticket),
+		wake:     make(chan struct{}, 1),
+		journal:  g.journal,
+	}
+	g.nextDispatch++
+	g.mu.Unlock()
 
 	for _, roadNum := range roads {
-		rd := g.getRoad(roadNum)
-		rd.addDispatcher(ch)
+		g.getRoad(roadNum).addDispatcher(d)
 	}
+	return d
+}
+
+// stops sending tickets to d. whatever it was sent but never delivered goes to the other dispatchers on the road,
+// or waits for the next one to show up.
+func (g *Controller) RemoveDispatcher(d *Dispatcher) {
+	// off every road first, so nothing new lands on it while we empty it
+	for _, roadNum := range d.roads {
+		g.getRoad(roadNum).removeDispatcher(d)
+	}
+	g.mu.RLock()
+	p := g.picker
+	g.mu.RUnlock()
+	p.forget(d)
 
+	byRoad := make(map[uint16][]*ticket)
+	for _, t := range d.takeUndelivered() {
+		byRoad[t.pl1.Road] = append(byRoad[t.pl1.Road], t)
+	}
+	for roadNum, tickets := range byRoad {
+		g.getRoad(roadNum).requeue(tickets)
+	}
 }
 
 func (g *Controller) AddPlates(plate *Plate) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
-
-	rd := g.getRoad(plate.Road)
-	rd.addPlate(plate)
+	g.getRoad(plate.Road).addPlate(plate)
 }
 
 func (g *Controller) getRoad(roadNum uint16) *road {
+	g.mu.RLock()
+	rd, ok := g.roads[roadNum]
+	g.mu.RUnlock()
+	if ok {
+		return rd
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	if _, ok := g.roads[roadNum]; !ok {
-		g.roads[roadNum] = makeRoad(roadNum)
+		g.roads[roadNum] = makeRoad(roadNum, g.book, g.journal, g.picker)
 	}
 	return g.roads[roadNum]
 }
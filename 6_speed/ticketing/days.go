@@ -0,0 +1,58 @@
+package ticketing
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+const numDayShards = 32
+
+// Which days every car already got a ticket for, whatever road it was on.
+// Split up by plate, so roads only wait on each other when they ticket cars in the same shard at the same time.
+type dayBook struct {
+	shards [numDayShards]*dayShard
+	seed   maphash.Seed
+}
+
+type dayShard struct {
+	days map[string]map[int]bool // by plate
+	mu   sync.Mutex
+}
+
+func makeDayBook() *dayBook {
+	b := &dayBook{
+		seed: maphash.MakeSeed(),
+	}
+	for i := range b.shards {
+		b.shards[i] = &dayShard{
+			days: make(map[string]map[int]bool),
+		}
+	}
+	return b
+}
+
+// takes every day the ticket covers for its car.
+// false if the car already has a ticket on any of them, and then nothing is taken.
+func (b *dayBook) claim(t *ticket) bool {
+	plate := t.pl1.Plate
+	sh := b.shards[maphash.String(b.seed, plate)%numDayShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	taken := sh.days[plate]
+	if taken == nil {
+		taken = make(map[int]bool)
+		sh.days[plate] = taken
+	}
+
+	days := t.days()
+	for _, d := range days {
+		if taken[d] {
+			return false
+		}
+	}
+	for _, d := range days {
+		taken[d] = true
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package ticketing
+
+import (
+	"context"
+	"log"
+	"protohackers/6_speed/infra"
+	"sync"
+)
+
+// A connected dispatcher, as far as ticketing is concerned.
+//
+// Tickets for its roads queue up here until the connection takes them with Next.
+// A ticket only counts as delivered once the connection says it was written with Delivered.
+// Once the dispatcher is removed, anything it took but never delivered goes back to its road for someone else.
+//
+// Roads push to it with their own lock held, so it never takes a road lock itself.
+type Dispatcher struct {
+	id       int
+	roads    []uint16
+	queue    []*ticket
+	inflight map[*infra.Ticket]*ticket // taken with Next, not delivered yet
+	wake     chan struct{}             // something got queued
+	removed  bool
+	sent     int // delivered, for seeing how evenly tickets get spread
+	journal  *journal
+	mu       sync.Mutex
+}
+
+// hands over a ticket
+func (d *Dispatcher) push(t *ticket) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.queue = append(d.queue, t)
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// waits for the next ticket. false once ctx is done, or the dispatcher was removed.
+func (d *Dispatcher) Next(ctx context.Context) (*infra.Ticket, bool) {
+	for {
+		d.mu.Lock()
+		if d.removed {
+			d.mu.Unlock()
+			return nil, false
+		}
+		if len(d.queue) > 0 {
+			t := d.queue[0]
+			d.queue = d.queue[1:]
+			enc := t.encode()
+			d.inflight[enc] = t
+			d.mu.Unlock()
+			return enc, true
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-d.wake:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// the ticket from Next made it onto the connection
+func (d *Dispatcher) Delivered(enc *infra.Ticket) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.inflight[enc]
+	if !ok {
+		return
+	}
+	delete(d.inflight, enc)
+	d.sent++
+	err := d.journal.append(ticketRecord(opDelivered, t))
+	if err != nil {
+		log.Println("journal:", err)
+	}
+	log.Printf("delivered ticket for %v on road %v", enc.Plate, enc.Road)
+}
+
+// tickets queued or in flight
+func (d *Dispatcher) outstanding() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.queue) + len(d.inflight)
+}
+
+// How a dispatcher is doing.
+type DispatcherStats struct {
+	ID          int
+	Roads       []uint16
+	Delivered   int
+	Outstanding int // queued or in flight
+}
+
+func (d *Dispatcher) Stats() DispatcherStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return DispatcherStats{
+		ID:          d.id,
+		Roads:       d.roads,
+		Delivered:   d.sent,
+		Outstanding: len(d.queue) + len(d.inflight),
+	}
+}
+
+// everything it has that never made it out, the ones in flight first since they were taken first.
+// they belong to someone else after this, so it doesn't hand out any more.
+func (d *Dispatcher) takeUndelivered() []*ticket {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.removed = true
+	ret := make([]*ticket, 0)
+	for _, t := range d.inflight {
+		ret = append(ret, t)
+	}
+	ret = append(ret, d.queue...)
+	d.queue = nil
+	clear(d.inflight)
+	return ret
+}
@@ -0,0 +1,453 @@
+package ticketing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	errCorrupt = fmt.Errorf("corrupt record")
+)
+
+const journalName = "journal"
+
+// Append only journal of everything ticketing needs to pick up where it left off:
+// speed limits, plates, tickets issued and tickets delivered.
+//
+// Records are written through to the OS as they come, so a crashed process loses nothing.
+// They only hit the disk on sync, so a crashed machine loses whatever came in since the last one.
+// A ticket delivered right before a crash can be sent again after it, but an issued one is never lost.
+//
+// Record layout:
+//
+//	op (1) | road uint16 | mile1 uint16 | timestamp1 uint32 | mile2 uint16 | timestamp2 uint32 | plate length (1) | plate | crc32 of everything before it
+//
+// limits keep the limit in mile1. plates only use the first mile and timestamp.
+// tickets and deliveries use all of it, the plate, road and timestamps are what tells tickets apart.
+type journal struct {
+	dir      string
+	lateness uint32 // seconds a plate can come in behind the newest one on its road, see journalState.compact
+	f        *os.File
+	w        *bufio.Writer
+	size     int64 // bytes in the journal, counting what's still buffered
+	mu       sync.Mutex
+
+	compactMu sync.Mutex // one compaction at a time
+}
+
+const (
+	opLimit byte = iota + 1
+	opPlate
+	opTicket
+	opDelivered
+)
+
+type record struct {
+	op    byte
+	road  uint16
+	mile1 uint16
+	ts1   uint32
+	mile2 uint16
+	ts2   uint32
+	plate string
+}
+
+func limitRecord(road uint16, limit uint16) record {
+	return record{op: opLimit, road: road, mile1: limit}
+}
+
+func plateRecord(pl *Plate) record {
+	return record{op: opPlate, road: pl.Road, mile1: pl.Mile, ts1: pl.Timestamp, plate: pl.Plate}
+}
+
+func ticketRecord(op byte, t *ticket) record {
+	return record{
+		op:    op,
+		road:  t.pl1.Road,
+		mile1: t.pl1.Mile,
+		ts1:   t.pl1.Timestamp,
+		mile2: t.pl2.Mile,
+		ts2:   t.pl2.Timestamp,
+		plate: t.pl1.Plate,
+	}
+}
+
+func (r record) ticket() *ticket {
+	return makeTicket(
+		&Plate{Plate: r.plate, Road: r.road, Mile: r.mile1, Timestamp: r.ts1},
+		&Plate{Plate: r.plate, Road: r.road, Mile: r.mile2, Timestamp: r.ts2},
+	)
+}
+
+func (r record) encode() []byte {
+	b := make([]byte, 0, recordHeader+len(r.plate)+4)
+	b = append(b, r.op)
+	b = binary.BigEndian.AppendUint16(b, r.road)
+	b = binary.BigEndian.AppendUint16(b, r.mile1)
+	b = binary.BigEndian.AppendUint32(b, r.ts1)
+	b = binary.BigEndian.AppendUint16(b, r.mile2)
+	b = binary.BigEndian.AppendUint32(b, r.ts2)
+	b = append(b, byte(len(r.plate)))
+	b = append(b, r.plate...)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	return b
+}
+
+const recordHeader = 1 + 2 + 2 + 4 + 2 + 4 + 1
+
+// returns the number of bytes read alongside the record
+func readRecord(r io.Reader) (record, int, error) {
+	var rec record
+
+	header := make([]byte, recordHeader)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return rec, 0, err
+	}
+	rec.op = header[0]
+	rec.road = binary.BigEndian.Uint16(header[1:3])
+	rec.mile1 = binary.BigEndian.Uint16(header[3:5])
+	rec.ts1 = binary.BigEndian.Uint32(header[5:9])
+	rec.mile2 = binary.BigEndian.Uint16(header[9:11])
+	rec.ts2 = binary.BigEndian.Uint32(header[11:15])
+	pl := int(header[15])
+
+	if rec.op < opLimit || rec.op > opDelivered {
+		return rec, 0, errCorrupt
+	}
+
+	b := make([]byte, pl+4)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return rec, 0, io.ErrUnexpectedEOF
+	}
+
+	sum := binary.BigEndian.Uint32(b[pl:])
+	if crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, b[:pl]) != sum {
+		return rec, 0, errCorrupt
+	}
+	// a ticket always goes forward in time, anything else didn't come from us
+	if (rec.op == opTicket || rec.op == opDelivered) && rec.ts1 > rec.ts2 {
+		return rec, 0, errCorrupt
+	}
+
+	rec.plate = string(b[:pl])
+	return rec, len(header) + len(b), nil
+}
+
+// what the journal adds up to
+type journalState struct {
+	limits    map[uint16]uint16
+	plates    []*Plate  // in the order they came in
+	tickets   []*ticket // every ticket issued, in order
+	delivered map[ticketKey]bool
+}
+
+type ticketKey struct {
+	plate string
+	road  uint16
+	ts1   uint32
+	ts2   uint32
+}
+
+func (t *ticket) key() ticketKey {
+	return ticketKey{
+		plate: t.pl1.Plate,
+		road:  t.pl1.Road,
+		ts1:   t.pl1.Timestamp,
+		ts2:   t.pl2.Timestamp,
+	}
+}
+
+func makeJournalState() *journalState {
+	return &journalState{
+		limits:    make(map[uint16]uint16),
+		plates:    make([]*Plate, 0),
+		tickets:   make([]*ticket, 0),
+		delivered: make(map[ticketKey]bool),
+	}
+}
+
+// replays every complete record in the journal.
+// a half written or corrupt record at the tail (crashed mid write) ends the replay.
+// returns the size of the journal up to the last good record.
+func readJournal(path string) (*journalState, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return makeJournalState(), 0, nil
+		}
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	return replay(bufio.NewReader(f))
+}
+
+func replay(r io.Reader) (*journalState, int64, error) {
+	st := makeJournalState()
+	var size int64
+	for {
+		rec, n, err := readRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errCorrupt) {
+				return st, size, nil
+			}
+			return nil, size, err
+		}
+		st.apply(rec)
+		size += int64(n)
+	}
+}
+
+func (st *journalState) apply(r record) {
+	switch r.op {
+	case opLimit:
+		st.limits[r.road] = r.mile1
+	case opPlate:
+		st.plates = append(st.plates, &Plate{Plate: r.plate, Road: r.road, Mile: r.mile1, Timestamp: r.ts1})
+	case opTicket:
+		st.tickets = append(st.tickets, r.ticket())
+	case opDelivered:
+		st.delivered[r.ticket().key()] = true
+	}
+}
+
+// how far apart two plates can be in time and still make a ticket on a road with this limit.
+// the furthest a car can go is the whole road, 65535 miles.
+// 0 means there's no telling (no limit yet), so everything is kept.
+func ticketWindow(limit uint16) uint32 {
+	if limit == 0 {
+		return 0
+	}
+	return uint32(65535 * 3600 / uint64(limit))
+}
+
+// the records that still matter.
+//
+// plates don't have to come in order, but on each road they're taken to come in at most lateness seconds
+// behind the newest one there. the oldest plate that can still come in pairs with plates up to a ticket window before it,
+// anything older than that can't make a ticket any more. a plate later than that still gets ticketed,
+// but what it pairs with might not be in the journal after a restart.
+// delivered tickets go once they end before the oldest day any road still has plates for,
+// since nothing can be ticketed on those days again. tickets that weren't delivered are always kept.
+func (st *journalState) compact(lateness uint32) []record {
+	newest := make(map[uint16]uint32)
+	for _, pl := range st.plates {
+		newest[pl.Road] = max(newest[pl.Road], pl.Timestamp)
+	}
+
+	cutoffs := make(map[uint16]uint32)
+	var oldest uint32
+	first := true
+	for road, ts := range newest {
+		var cutoff uint32
+		window := ticketWindow(st.limits[road])
+		if window != 0 && uint64(ts) > uint64(lateness)+uint64(window) {
+			cutoff = ts - lateness - window
+		}
+		cutoffs[road] = cutoff
+		if first || cutoff < oldest {
+			oldest = cutoff
+			first = false
+		}
+	}
+
+	ret := make([]record, 0)
+	for road, limit := range st.limits {
+		ret = append(ret, limitRecord(road, limit))
+	}
+	for _, pl := range st.plates {
+		if pl.Timestamp >= cutoffs[pl.Road] {
+			ret = append(ret, plateRecord(pl))
+		}
+	}
+	for _, t := range st.tickets {
+		if !st.delivered[t.key()] {
+			ret = append(ret, ticketRecord(opTicket, t))
+			continue
+		}
+		if t.pl2.Timestamp/86400 >= oldest/86400 {
+			ret = append(ret, ticketRecord(opTicket, t), ticketRecord(opDelivered, t))
+		}
+	}
+	return ret
+}
+
+// open the journal in dir for appending.
+// anything after size is thrown away.
+func openJournal(dir string, size int64, lateness uint32) (*journal, error) {
+	f, err := os.OpenFile(filepath.Join(dir, journalName), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	_, err = f.Seek(size, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &journal{
+		dir:      dir,
+		lateness: lateness,
+		f:        f,
+		w:        bufio.NewWriter(f),
+		size:     size,
+	}, nil
+}
+
+// a nil journal (nothing persisted) takes everything and does nothing with it
+func (j *journal) append(r record) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	n, err := j.w.Write(r.encode())
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return j.w.Flush()
+}
+
+// whether a plate at ts came in further behind the newest one on its road than compaction allows for
+func (j *journal) tooLate(ts uint32, newest uint32) bool {
+	return j != nil && uint64(ts)+uint64(j.lateness) < uint64(newest)
+}
+
+func (j *journal) sync() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := j.w.Flush()
+	if err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// rewrites the journal with only what still matters.
+// goes through a temporary file so a crash leaves either the old journal or the new one.
+//
+// what's in the journal when it starts gets read and compacted without the lock, so appends carry on meanwhile.
+// they only wait for the records that came in since then to be copied over, and the rename.
+func (j *journal) compact() error {
+	if j == nil {
+		return nil
+	}
+	j.compactMu.Lock()
+	defer j.compactMu.Unlock()
+
+	j.mu.Lock()
+	err := j.w.Flush()
+	size := j.size
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(j.dir, journalName)
+	old, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	// still the old journal after the rename
+	defer old.Close()
+
+	st, _, err := replay(bufio.NewReader(io.NewSectionReader(old, 0, size)))
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var newSize int64
+	for _, r := range st.compact(j.lateness) {
+		n, _ := w.Write(r.encode())
+		newSize += int64(n)
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err = j.w.Flush()
+	var tail int64
+	if err == nil {
+		tail, err = io.Copy(f, io.NewSectionReader(old, size, j.size-size))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	err = syncDir(j.dir)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// the temporary file is the journal now, keep appending to it
+	j.f.Close()
+	j.f = f
+	j.w = bufio.NewWriter(f)
+	j.size = newSize + tail
+	log.Printf("compacted journal from %v to %v bytes", size, newSize)
+	return nil
+}
+
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := j.w.Flush()
+	if err == nil {
+		err = j.f.Sync()
+	}
+	j.f.Close()
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,210 @@
+package ticketing_test
+
+import (
+	"os"
+	"path/filepath"
+	"protohackers/6_speed/ticketing"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, dir string) *ticketing.Controller {
+	return openLate(t, dir, 24*time.Hour)
+}
+
+func openLate(t *testing.T, dir string, lateness time.Duration) *ticketing.Controller {
+	c, err := ticketing.Open(dir, lateness)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return c
+}
+
+// every ticket the dispatcher gets right now
+func drainTickets(d *ticketing.Dispatcher) []string {
+	got := make([]string, 0)
+	for tick := next(d); tick != nil; tick = next(d) {
+		got = append(got, tick.Plate)
+	}
+	return got
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	var roadNum uint16 = 1
+
+	c := open(t, dir)
+	c.UpdateLimit(roadNum, 60)
+	d := c.AddDispatcher([]uint16{roadNum})
+	for _, plate := range []string{"AAA", "BBB", "CCC"} {
+		c.AddPlates(&ticketing.Plate{Plate: plate, Road: roadNum, Mile: 0, Timestamp: 0})
+		c.AddPlates(&ticketing.Plate{Plate: plate, Road: roadNum, Mile: 50, Timestamp: 600})
+	}
+	c.AddPlates(&ticketing.Plate{Plate: "DDD", Road: roadNum, Mile: 0, Timestamp: 0})
+
+	// only the first one gets out before the crash, the dispatcher never gets removed
+	if tick := next(d); tick == nil || tick.Plate != "AAA" {
+		t.Fatalf("wrong ticket. expected AAA got %v", tick)
+	}
+	c.Close()
+
+	c = open(t, dir)
+	defer c.Close()
+	d = c.AddDispatcher([]uint16{roadNum})
+
+	got := drainTickets(d)
+	expected := []string{"BBB", "CCC"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets after restart. expected %v got %v", expected, got)
+	}
+
+	// already has a ticket today
+	c.AddPlates(&ticketing.Plate{Plate: "AAA", Road: roadNum, Mile: 100, Timestamp: 1200})
+	// pairs up with the plate from before the restart, at the limit from before the restart
+	c.AddPlates(&ticketing.Plate{Plate: "DDD", Road: roadNum, Mile: 50, Timestamp: 600})
+
+	got = drainTickets(d)
+	expected = []string{"DDD"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets after restart. expected %v got %v", expected, got)
+	}
+}
+
+// a crash halfway through a write leaves a partial record at the end
+func TestJournalTornTail(t *testing.T) {
+	dir := t.TempDir()
+	var roadNum uint16 = 1
+
+	c := open(t, dir)
+	c.UpdateLimit(roadNum, 60)
+	c.AddPlates(&ticketing.Plate{Plate: "AAA", Road: roadNum, Mile: 0, Timestamp: 0})
+	c.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, "journal"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	f.Write([]byte{2, 0, 1, 0})
+	f.Close()
+
+	c = open(t, dir)
+	c.AddPlates(&ticketing.Plate{Plate: "AAA", Road: roadNum, Mile: 50, Timestamp: 600})
+	c.Close()
+
+	// the ticket made after the torn record has to come back too
+	c = open(t, dir)
+	defer c.Close()
+	got := drainTickets(c.AddDispatcher([]uint16{roadNum}))
+	expected := []string{"AAA"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets. expected %v got %v", expected, got)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal")
+	var roadNum uint16 = 1
+
+	c := open(t, dir)
+	c.UpdateLimit(roadNum, 60)
+
+	// way too slow to ever be ticketed, and too old once the new plates come in
+	for i := range 1000 {
+		c.AddPlates(&ticketing.Plate{Plate: "OLD", Road: roadNum, Mile: 0, Timestamp: uint32(i * 3600)})
+	}
+	// old, but never delivered
+	c.AddPlates(&ticketing.Plate{Plate: "LATE", Road: roadNum, Mile: 0, Timestamp: 0})
+	c.AddPlates(&ticketing.Plate{Plate: "LATE", Road: roadNum, Mile: 50, Timestamp: 600})
+
+	// a window at 60 mph is 65535 miles worth, about 45 days
+	var now uint32 = 100 * 86400
+	c.AddPlates(&ticketing.Plate{Plate: "NEW", Road: roadNum, Mile: 0, Timestamp: now})
+
+	before, _ := os.Stat(path)
+	err := c.Compact()
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size()/10 {
+		t.Fatalf("journal barely shrunk. expected under %v got %v", before.Size()/10, after.Size())
+	}
+
+	// still appending to the compacted journal
+	c.AddPlates(&ticketing.Plate{Plate: "NEW", Road: roadNum, Mile: 50, Timestamp: now + 600})
+	c.Close()
+
+	c = open(t, dir)
+	defer c.Close()
+	got := drainTickets(c.AddDispatcher([]uint16{roadNum}))
+	expected := []string{"LATE", "NEW"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets after compaction. expected %v got %v", expected, got)
+	}
+}
+
+// plates come in out of order, so one way behind the newest still has to find its pair after compaction
+func TestJournalCompactLate(t *testing.T) {
+	dir := t.TempDir()
+	var roadNum uint16 = 1
+
+	c := openLate(t, dir, 60*24*time.Hour)
+	c.UpdateLimit(roadNum, 60)
+
+	// more than a ticket window behind the newest, but not more than the lateness plus the window
+	var then uint32 = 50 * 86400
+	var now uint32 = 100 * 86400
+	c.AddPlates(&ticketing.Plate{Plate: "LATE", Road: roadNum, Mile: 0, Timestamp: then})
+	c.AddPlates(&ticketing.Plate{Plate: "NEW", Road: roadNum, Mile: 0, Timestamp: now})
+	err := c.Compact()
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	c.Close()
+
+	c = openLate(t, dir, 60*24*time.Hour)
+	defer c.Close()
+	c.AddPlates(&ticketing.Plate{Plate: "LATE", Road: roadNum, Mile: 50, Timestamp: then + 600})
+	got := drainTickets(c.AddDispatcher([]uint16{roadNum}))
+	expected := []string{"LATE"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets after compaction. expected %v got %v", expected, got)
+	}
+}
+
+// plates keep coming in while the journal is being compacted, none of them can get lost
+func TestJournalCompactConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	var roadNum uint16 = 1
+
+	c := open(t, dir)
+	c.UpdateLimit(roadNum, 60)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			speedOnDay(c, roadNum, strconv.Itoa(i), 0)
+		}
+	}()
+	for range 20 {
+		err := c.Compact()
+		if err != nil {
+			t.Fatalf("compact: %v", err)
+		}
+	}
+	wg.Wait()
+	c.Close()
+
+	c = open(t, dir)
+	defer c.Close()
+	got := drainTickets(c.AddDispatcher([]uint16{roadNum}))
+	if len(got) != 200 {
+		t.Fatalf("wrong number of tickets after compaction. expected 200 got %v", len(got))
+	}
+}
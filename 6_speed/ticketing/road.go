@@ -2,30 +2,45 @@ package ticketing
 
 import (
 	"log"
-	"math"
-	"math/rand"
-	"protohackers/6_speed/infra"
+	"slices"
+	"sync"
 )
 
-// handles most of the traffic logic
+// handles most of the traffic logic.
+// every road has its own lock, so a busy road doesn't hold up the rest.
+// the methods take it themselves.
 type road struct {
 	num         uint16
-	dispatchers []chan *infra.Ticket
+	dispatchers []*Dispatcher
 	cars        map[string]*car
 	limit       uint16
-	sent        map[*ticket]bool
+	newest      uint32    // timestamp of the newest plate
+	pending     []*ticket // waiting for a dispatcher to show up
+	book        *dayBook  // shared by every road
+	journal     *journal  // nil if nothing is persisted
+	picker      picker    // which dispatcher gets each ticket
+	mu          sync.Mutex
 }
 
-func makeRoad(roadNum uint16) *road {
+func makeRoad(roadNum uint16, book *dayBook, j *journal, p picker) *road {
 	return &road{
 		num:         roadNum,
-		dispatchers: make([]chan *infra.Ticket, 0),
+		dispatchers: make([]*Dispatcher, 0),
 		cars:        make(map[string]*car),
-		sent:        make(map[*ticket]bool),
+		pending:     make([]*ticket, 0),
+		book:        book,
+		journal:     j,
+		picker:      p,
 	}
 }
 
 func (rd *road) updateLimit(limit uint16) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if rd.limit != limit {
+		rd.write(limitRecord(rd.num, limit))
+	}
 	rd.limit = limit
 	log.Printf("Road %v got speed limit updated to: %v", rd.num, limit)
 }
@@ -38,51 +53,83 @@ func (rd *road) getCar(plate string) *car {
 }
 
 func (rd *road) addPlate(plate *Plate) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	rd.write(plateRecord(plate))
+	if rd.journal.tooLate(plate.Timestamp, rd.newest) {
+		log.Printf("Plate %v on road %v came in too late for the journal, its tickets might not survive a restart", plate.Plate, rd.num)
+	}
+	rd.newest = max(rd.newest, plate.Timestamp)
 	car := rd.getCar(plate.Plate)
-	car.addPlate(plate)
+	for _, t := range car.addPlate(plate, float64(rd.limit)) {
+		if rd.book.claim(t) {
+			rd.write(ticketRecord(opTicket, t))
+			rd.pending = append(rd.pending, t)
+		}
+	}
 	rd.processTicket()
 }
 
-func (rd *road) addDispatcher(ch chan *infra.Ticket) {
-	rd.dispatchers = append(rd.dispatchers, ch)
+// journals under the road lock, so the journal has things in the order they happened.
+// a failed write only gets logged, tickets keep going out either way.
+func (rd *road) write(r record) {
+	err := rd.journal.append(r)
+	if err != nil {
+		log.Println("journal:", err)
+	}
+}
+
+func (rd *road) addDispatcher(d *Dispatcher) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	rd.dispatchers = append(rd.dispatchers, d)
 	log.Printf("Dispatcher registered on road %v", rd.num)
 	rd.processTicket()
 }
 
-func (rd *road) processTicket() {
-	// set nulls to false
-	for _, c := range rd.cars {
-		for _, t := range c.getViolations(float64(rd.limit)) {
-			if _, ok := rd.sent[t]; !ok {
-				rd.sent[t] = false
-			}
-		}
+func (rd *road) removeDispatcher(d *Dispatcher) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	rd.dispatchers = slices.DeleteFunc(rd.dispatchers, func(other *Dispatcher) bool {
+		return other == d
+	})
+	log.Printf("Dispatcher removed from road %v", rd.num)
+}
+
+func (rd *road) setPicker(p picker) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	rd.picker = p
+}
+
+// tickets somebody else had but never delivered
+func (rd *road) requeue(tickets []*ticket) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	for _, t := range tickets {
+		log.Printf("requeueing ticket for %v on road %v", t.pl1.Plate, rd.num)
 	}
+	rd.pending = append(rd.pending, tickets...)
+	rd.processTicket()
+}
 
+// hands whatever tickets are pending to the dispatchers, if there are any.
+// they sit in the dispatcher's queue until its connection picks them up, so this never blocks.
+// needs the lock.
+func (rd *road) processTicket() {
 	if len(rd.dispatchers) == 0 {
 		return
 	}
 
-	for ticket, sent := range rd.sent {
-		if sent {
-			continue
-		}
-
-		mph := ticket.speed()
-		ticketingSpeed := uint16(math.Round(mph * 100))
-
-		randDisp := rand.Int() % len(rd.dispatchers)
-		rd.dispatchers[randDisp] <- &infra.Ticket{
-			Plate:      ticket.pl1.Plate,
-			Road:       ticket.pl1.Road,
-			Mile1:      ticket.pl1.Mile,
-			Timestamp1: ticket.pl1.Timestamp,
-			Mile2:      ticket.pl2.Mile,
-			Timestamp2: ticket.pl2.Timestamp,
-			Speed:      uint16(math.Round(mph * 100)),
-		}
-		rd.sent[ticket] = true
-
-		log.Printf("ticketing %v. Speed (mph): %v > %v. Ticketing speed: %v\n", ticket.pl1.Plate, mph, rd.limit, ticketingSpeed)
+	for _, ticket := range rd.pending {
+		d := rd.picker.pick(ticket, rd.dispatchers)
+		d.push(ticket)
+		log.Printf("ticketing %v to dispatcher %v. Speed (mph): %v > %v", ticket.pl1.Plate, d.id, ticket.speed(), rd.limit)
 	}
+	rd.pending = rd.pending[:0]
 }
@@ -0,0 +1,113 @@
+package ticketing
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrUnknownStrategy = fmt.Errorf("strategy has to be random, round-robin, least-outstanding or sticky")
+)
+
+// Picks which of a road's dispatchers gets a ticket.
+// There's one for the whole controller, so whatever state it keeps it locks itself.
+// Roads call it with their lock held, so it can lock dispatchers but nothing else. ds is never empty.
+type picker interface {
+	pick(t *ticket, ds []*Dispatcher) *Dispatcher
+	// d is off every road for good
+	forget(d *Dispatcher)
+}
+
+var strategies = map[string]func() picker{
+	"random": func() picker { return randomPicker{} },
+	"round-robin": func() picker {
+		return &roundRobinPicker{
+			next: make(map[uint16]int),
+		}
+	},
+	"least-outstanding": func() picker { return leastOutstandingPicker{} },
+	"sticky": func() picker {
+		return &stickyPicker{
+			cars: make(map[string]*Dispatcher),
+		}
+	},
+}
+
+type randomPicker struct{}
+
+func (randomPicker) pick(t *ticket, ds []*Dispatcher) *Dispatcher {
+	return ds[rand.IntN(len(ds))]
+}
+
+func (randomPicker) forget(d *Dispatcher) {}
+
+// takes turns, in the order they registered on the road
+type roundRobinPicker struct {
+	next map[uint16]int // by road
+	mu   sync.Mutex
+}
+
+func (p *roundRobinPicker) pick(t *ticket, ds []*Dispatcher) *Dispatcher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	road := t.pl1.Road
+	d := ds[p.next[road]%len(ds)]
+	p.next[road] = (p.next[road] + 1) % len(ds)
+	return d
+}
+
+func (p *roundRobinPicker) forget(d *Dispatcher) {}
+
+// whoever has the fewest tickets queued or in flight. the first one to register wins ties.
+type leastOutstandingPicker struct{}
+
+func (leastOutstandingPicker) pick(t *ticket, ds []*Dispatcher) *Dispatcher {
+	best := ds[0]
+	least := best.outstanding()
+	for _, d := range ds[1:] {
+		n := d.outstanding()
+		if n < least {
+			best, least = d, n
+		}
+	}
+	return best
+}
+
+func (leastOutstandingPicker) forget(d *Dispatcher) {}
+
+// the same car always goes to the same dispatcher, on every road that one is on, for as long as it's connected.
+// cars it hasn't seen, or whose dispatcher isn't on the road, go to whoever has the least outstanding.
+type stickyPicker struct {
+	cars map[string]*Dispatcher // by plate
+	mu   sync.Mutex
+}
+
+func (p *stickyPicker) pick(t *ticket, ds []*Dispatcher) *Dispatcher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	plate := t.pl1.Plate
+	d, ok := p.cars[plate]
+	if ok && slices.Contains(ds, d) {
+		return d
+	}
+	best := leastOutstandingPicker{}.pick(t, ds)
+	// still connected, just not on this road. the car stays with it everywhere else.
+	if !ok {
+		p.cars[plate] = best
+	}
+	return best
+}
+
+func (p *stickyPicker) forget(d *Dispatcher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	maps.DeleteFunc(p.cars, func(plate string, other *Dispatcher) bool {
+		return other == d
+	})
+}
@@ -0,0 +1,131 @@
+package ticketing_test
+
+import (
+	"errors"
+	"protohackers/6_speed/ticketing"
+	"reflect"
+	"testing"
+)
+
+// a ticket for the car on that day
+func speedOnDay(c *ticketing.Controller, road uint16, plate string, day uint32) {
+	c.AddPlates(&ticketing.Plate{Plate: plate, Road: road, Mile: 0, Timestamp: day * 86400})
+	c.AddPlates(&ticketing.Plate{Plate: plate, Road: road, Mile: 50, Timestamp: day*86400 + 600})
+}
+
+func delivered(c *ticketing.Controller) []int {
+	ret := make([]int, 0)
+	for _, st := range c.Stats() {
+		ret = append(ret, st.Delivered)
+	}
+	return ret
+}
+
+func TestStrategies(t *testing.T) {
+	type strategyTestCase struct {
+		strategy string
+		expected []int // delivered per dispatcher
+	}
+
+	// 3 dispatchers, 6 tickets for 6 cars. the first one gets each of its tickets out right away, the others sit on theirs.
+	// so the first one never has anything outstanding, and new cars always go to it.
+	cases := []strategyTestCase{
+		{strategy: "round-robin", expected: []int{2, 2, 2}},
+		{strategy: "least-outstanding", expected: []int{6, 0, 0}},
+		{strategy: "sticky", expected: []int{6, 0, 0}},
+	}
+
+	for _, tc := range cases {
+		c := ticketing.MakeController()
+		err := c.UseStrategy(tc.strategy)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.strategy, err)
+		}
+		var roadNum uint16 = 1
+		c.UpdateLimit(roadNum, 60)
+		ds := []*ticketing.Dispatcher{
+			c.AddDispatcher([]uint16{roadNum}),
+			c.AddDispatcher([]uint16{roadNum}),
+			c.AddDispatcher([]uint16{roadNum}),
+		}
+
+		for i, plate := range []string{"A", "B", "C", "D", "E", "F"} {
+			speedOnDay(c, roadNum, plate, uint32(i))
+			next(ds[0])
+		}
+		for _, d := range ds[1:] {
+			drainTickets(d)
+		}
+
+		got := delivered(c)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Fatalf("wrong spread for %v. expected %v got %v", tc.strategy, tc.expected, got)
+		}
+	}
+}
+
+func TestStickyStrategy(t *testing.T) {
+	c := ticketing.MakeController()
+	c.UseStrategy("sticky")
+	var roadNum uint16 = 1
+	c.UpdateLimit(roadNum, 60)
+	d1 := c.AddDispatcher([]uint16{roadNum})
+	d2 := c.AddDispatcher([]uint16{roadNum})
+
+	// nobody takes anything, so only stickiness keeps a car on one dispatcher
+	for day := range uint32(4) {
+		speedOnDay(c, roadNum, "AAA", day)
+		speedOnDay(c, roadNum, "BBB", day)
+	}
+
+	expected := []string{"AAA", "AAA", "AAA", "AAA"}
+	if got := drainTickets(d1); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets for first dispatcher. expected %v got %v", expected, got)
+	}
+	expected = []string{"BBB", "BBB", "BBB", "BBB"}
+	if got := drainTickets(d2); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets for second dispatcher. expected %v got %v", expected, got)
+	}
+
+	// its dispatcher is gone, so the car moves on to one that's still there
+	c.RemoveDispatcher(d1)
+	speedOnDay(c, roadNum, "AAA", 10)
+	expected = []string{"AAA"}
+	if got := drainTickets(d2); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets after the first dispatcher left. expected %v got %v", expected, got)
+	}
+}
+
+// one car on two roads, with both dispatchers on both
+func TestStickyAcrossRoads(t *testing.T) {
+	c := ticketing.MakeController()
+	c.UseStrategy("sticky")
+	roads := []uint16{1, 2}
+	for _, roadNum := range roads {
+		c.UpdateLimit(roadNum, 60)
+	}
+	d1 := c.AddDispatcher(roads)
+	d2 := c.AddDispatcher(roads)
+
+	// BBB goes to the first one, which then has more outstanding than the second
+	speedOnDay(c, 1, "BBB", 0)
+	speedOnDay(c, 1, "AAA", 1)
+	// both have one outstanding now, a tie the first dispatcher would win
+	speedOnDay(c, 2, "AAA", 2)
+
+	expected := []string{"BBB"}
+	if got := drainTickets(d1); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets for first dispatcher. expected %v got %v", expected, got)
+	}
+	expected = []string{"AAA", "AAA"}
+	if got := drainTickets(d2); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets for second dispatcher. expected %v got %v", expected, got)
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	err := ticketing.MakeController().UseStrategy("fastest")
+	if !errors.Is(err, ticketing.ErrUnknownStrategy) {
+		t.Fatalf("wrong error. expected %v got %v", ticketing.ErrUnknownStrategy, err)
+	}
+}
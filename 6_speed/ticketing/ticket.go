@@ -2,6 +2,7 @@ package ticketing
 
 import (
 	"math"
+	"protohackers/6_speed/infra"
 )
 
 // this is a prospective ticket
@@ -32,6 +33,19 @@ func (t *ticket) speed() float64 {
 	return math.Abs(mph)
 }
 
+// what goes out to the dispatcher. speed is in hundredths of a mph.
+func (t *ticket) encode() *infra.Ticket {
+	return &infra.Ticket{
+		Plate:      t.pl1.Plate,
+		Road:       t.pl1.Road,
+		Mile1:      t.pl1.Mile,
+		Timestamp1: t.pl1.Timestamp,
+		Mile2:      t.pl2.Mile,
+		Timestamp2: t.pl2.Timestamp,
+		Speed:      uint16(math.Round(t.speed() * 100)),
+	}
+}
+
 func (t *ticket) days() []int {
 	ret := make([]int, 0)
 	startDay := math.Floor(float64(t.pl1.Timestamp) / 86400)
@@ -1,12 +1,32 @@
 package ticketing_test
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
 	"protohackers/6_speed/infra"
 	"protohackers/6_speed/ticketing"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
+// the next ticket the dispatcher was sent, delivered right away. nil if there is none yet.
+func next(d *ticketing.Dispatcher) *infra.Ticket {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	t, ok := d.Next(ctx)
+	if !ok {
+		return nil
+	}
+	d.Delivered(t)
+	return t
+}
+
 func TestTicketingBasic(t *testing.T) {
 	type basicTestCases struct {
 		expected *infra.Ticket
@@ -74,9 +94,8 @@ func TestTicketingBasic(t *testing.T) {
 
 		// Need to buffer ticket first if no dispatcher.
 		// So we register it late to test for that.
-		outCh := make(chan *infra.Ticket, 1)
-		c.AddDispatcher([]uint16{roadNum}, outCh)
-		out := <-outCh
+		d := c.AddDispatcher([]uint16{roadNum})
+		out := next(d)
 
 		if !reflect.DeepEqual(out, ticketCase.expected) {
 			t.Fatalf("ticket different. expected %v. got %v", ticketCase.expected, out)
@@ -93,8 +112,7 @@ func TestTicketingDay1(t *testing.T) {
 
 	c.UpdateLimit(roadNum, 60)
 
-	outCh := make(chan *infra.Ticket, 2)
-	c.AddDispatcher([]uint16{roadNum}, outCh)
+	d := c.AddDispatcher([]uint16{roadNum})
 
 	c.AddPlates(&ticketing.Plate{
 		Plate:     plate,
@@ -117,12 +135,11 @@ func TestTicketingDay1(t *testing.T) {
 		Timestamp: 90,
 	})
 
-	<-outCh
-
-	select {
-	case <-outCh:
+	if next(d) == nil {
+		t.Fatalf("expected a ticket")
+	}
+	if next(d) != nil {
 		t.Fatalf("got two tickets on same day. expected only 1")
-	default:
 	}
 }
 
@@ -134,8 +151,7 @@ func TestTicketingDay2(t *testing.T) {
 	var roadNum uint16 = 10
 	var plate string = "UN1X"
 
-	outCh := make(chan *infra.Ticket, 2)
-	c.AddDispatcher([]uint16{roadNum}, outCh)
+	d := c.AddDispatcher([]uint16{roadNum})
 
 	c.UpdateLimit(roadNum, 60)
 
@@ -160,12 +176,11 @@ func TestTicketingDay2(t *testing.T) {
 		Timestamp: 0,
 	})
 
-	<-outCh
-
-	select {
-	case <-outCh:
+	if next(d) == nil {
+		t.Fatalf("expected a ticket")
+	}
+	if next(d) != nil {
 		t.Fatalf("got two tickets on same day. expected only 1")
-	default:
 	}
 }
 
@@ -176,8 +191,7 @@ func TestTicketingDay3(t *testing.T) {
 	var roadNum uint16 = 10
 	var plate string = "UN1X"
 
-	outCh := make(chan *infra.Ticket, 2)
-	c.AddDispatcher([]uint16{roadNum}, outCh)
+	d := c.AddDispatcher([]uint16{roadNum})
 
 	c.UpdateLimit(roadNum, 60)
 
@@ -209,11 +223,255 @@ func TestTicketingDay3(t *testing.T) {
 		Timestamp: 38364285,
 	})
 
-	<-outCh
-
-	select {
-	case <-outCh:
+	if next(d) == nil {
+		t.Fatalf("expected a ticket")
+	}
+	if next(d) != nil {
 		t.Fatalf("got two tickets on same day. expected only 1")
-	default:
+	}
+}
+
+// a plate landing in between two others only makes pairs with those two
+func TestTicketingInBetween(t *testing.T) {
+	c := ticketing.MakeController()
+	var roadNum uint16 = 10
+	var plate string = "UN1X"
+
+	d := c.AddDispatcher([]uint16{roadNum})
+	c.UpdateLimit(roadNum, 60)
+
+	// 50 mph between these two, fine
+	c.AddPlates(&ticketing.Plate{
+		Plate:     plate,
+		Road:      roadNum,
+		Mile:      0,
+		Timestamp: 0,
+	})
+	c.AddPlates(&ticketing.Plate{
+		Plate:     plate,
+		Road:      roadNum,
+		Mile:      100,
+		Timestamp: 7200,
+	})
+	if tick := next(d); tick != nil {
+		t.Fatalf("expected no ticket yet. got %v", tick)
+	}
+
+	// but 300 mph to get here from the first one
+	c.AddPlates(&ticketing.Plate{
+		Plate:     plate,
+		Road:      roadNum,
+		Mile:      50,
+		Timestamp: 600,
+	})
+
+	expected := &infra.Ticket{
+		Plate:      plate,
+		Road:       roadNum,
+		Mile1:      0,
+		Timestamp1: 0,
+		Mile2:      50,
+		Timestamp2: 600,
+		Speed:      30000,
+	}
+	out := next(d)
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("ticket different. expected %v. got %v", expected, out)
+	}
+}
+
+// tickets a dispatcher never delivered go to another one once it's gone
+func TestTicketingRequeue(t *testing.T) {
+	c := ticketing.MakeController()
+
+	var roadNum uint16 = 10
+	c.UpdateLimit(roadNum, 60)
+
+	speeding := func(plate string) {
+		c.AddPlates(&ticketing.Plate{Plate: plate, Road: roadNum, Mile: 0, Timestamp: 0})
+		c.AddPlates(&ticketing.Plate{Plate: plate, Road: roadNum, Mile: 50, Timestamp: 600})
+	}
+
+	gone := c.AddDispatcher([]uint16{roadNum})
+	speeding("AAA")
+	speeding("BBB")
+	speeding("CCC")
+
+	// takes the first two but only gets the second one out, never even looks at the third
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	gone.Next(ctx)
+	second, _ := gone.Next(ctx)
+	gone.Delivered(second)
+
+	c.RemoveDispatcher(gone)
+
+	// nobody to send them to until this one shows up
+	d := c.AddDispatcher([]uint16{roadNum})
+	got := make([]string, 0)
+	for tick := next(d); tick != nil; tick = next(d) {
+		got = append(got, tick.Plate)
+	}
+
+	expected := []string{"AAA", "CCC"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("wrong tickets requeued. expected %v got %v", expected, got)
+	}
+}
+
+// one ticket a day per car, no matter how many roads it sped on
+func TestTicketingAcrossRoads(t *testing.T) {
+	c := ticketing.MakeController()
+
+	var plate string = "UN1X"
+	c.UpdateLimit(1, 60)
+	c.UpdateLimit(2, 60)
+	d := c.AddDispatcher([]uint16{1, 2})
+
+	c.AddPlates(&ticketing.Plate{Plate: plate, Road: 1, Mile: 0, Timestamp: 0})
+	c.AddPlates(&ticketing.Plate{Plate: plate, Road: 1, Mile: 50, Timestamp: 600})
+	c.AddPlates(&ticketing.Plate{Plate: plate, Road: 2, Mile: 0, Timestamp: 1000})
+	c.AddPlates(&ticketing.Plate{Plate: plate, Road: 2, Mile: 50, Timestamp: 1600})
+
+	if next(d) == nil {
+		t.Fatalf("expected a ticket")
+	}
+	if tick := next(d); tick != nil {
+		t.Fatalf("got two tickets on same day on different roads. expected only 1. got %v", tick)
+	}
+}
+
+// lots of roads, cars and dispatchers at once, some of the dispatchers hanging up halfway.
+// every car speeds on two roads every day, so each one should get exactly one ticket a day.
+func TestTicketingStress(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const roads = 8
+	const cars = 50
+	const days = 5
+
+	c := ticketing.MakeController()
+	for r := range uint16(roads) {
+		c.UpdateLimit(r, 60)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	delivered := make(map[string]int) // by plate and day
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	// delivers until ctx is done. with a lifetime, it hangs up with a ticket in hand after that many,
+	// and another one takes its place.
+	var dispatch func(roads []uint16, lifetime int)
+	dispatch = func(roads []uint16, lifetime int) {
+		defer wg.Done()
+		d := c.AddDispatcher(roads)
+		for n := 0; ; n++ {
+			tick, ok := d.Next(ctx)
+			if !ok {
+				return
+			}
+			if lifetime > 0 && n == lifetime {
+				c.RemoveDispatcher(d)
+				wg.Add(1)
+				go dispatch(roads, lifetime)
+				return
+			}
+			d.Delivered(tick)
+
+			mu.Lock()
+			delivered[fmt.Sprintf("%v/%v", tick.Plate, tick.Timestamp1/86400)]++
+			mu.Unlock()
+		}
+	}
+	for r := range uint16(roads) {
+		wg.Add(2)
+		go dispatch([]uint16{r, (r + 1) % roads}, 0)
+		go dispatch([]uint16{r, (r + 2) % roads}, 3)
+	}
+
+	// one feeder per road, each car takes a different pair of roads every day
+	var feeders sync.WaitGroup
+	for r := range roads {
+		feeders.Add(1)
+		go func() {
+			defer feeders.Done()
+			for day := range days {
+				for car := range cars {
+					base := uint32(day * 86400)
+					plate := fmt.Sprintf("CAR%v", car)
+					switch r {
+					case (car + day) % roads:
+						base += 1000
+					case (car + day + 1) % roads:
+						base += 5000
+					default:
+						continue
+					}
+					c.AddPlates(&ticketing.Plate{Plate: plate, Road: uint16(r), Mile: 0, Timestamp: base})
+					c.AddPlates(&ticketing.Plate{Plate: plate, Road: uint16(r), Mile: 50, Timestamp: base + 600})
+				}
+			}
+		}()
+	}
+	feeders.Wait()
+
+	total := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered)
+	}
+	for deadline := time.Now().Add(10 * time.Second); total() < cars*days; {
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong number of tickets. expected %v got %v", cars*days, total())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	for key, n := range delivered {
+		if n != 1 {
+			t.Fatalf("wrong number of tickets for %v. expected 1 got %v", key, n)
+		}
+	}
+}
+
+// every car speeding past cameras one mile apart, one observation per iteration
+func BenchmarkAddPlates(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// out of order, every plate lands somewhere in the middle of its car's list and the rest has to shift over
+	for _, shuffled := range []bool{false, true} {
+		for _, fleet := range []int{100, 1000, 10000} {
+			b.Run(fmt.Sprintf("shuffled=%v/fleet=%v", shuffled, fleet), func(b *testing.B) {
+				c := ticketing.MakeController()
+				var roadNum uint16 = 10
+				c.UpdateLimit(roadNum, 60)
+
+				d := c.AddDispatcher([]uint16{roadNum})
+				rnd := rand.New(rand.NewPCG(1, 2))
+
+				b.ResetTimer()
+				for i := range b.N {
+					seen := uint32(i / fleet)
+					if shuffled {
+						seen = rnd.Uint32N(1 << 20)
+					}
+					c.AddPlates(&ticketing.Plate{
+						Plate:     fmt.Sprintf("CAR%v", i%fleet),
+						Road:      roadNum,
+						Mile:      uint16(seen),
+						Timestamp: seen * 30,
+					})
+					for next(d) != nil {
+					}
+				}
+			})
+		}
 	}
 }